@@ -1,7 +1,7 @@
 package tqtemplate
 
 import (
-	"fmt"
+	"io"
 	"strings"
 )
 
@@ -21,32 +21,6 @@ func (t *Template) findExtendsNode(tree *TreeNode) *TreeNode {
 	return nil
 }
 
-// renderWithExtendsAndFilters handles template inheritance
-func (t *Template) renderWithExtends(childTree *TreeNode, extendsNode *TreeNode, data map[string]any, filters map[string]any) (string, error) {
-	if t.loader == nil {
-		return "", fmt.Errorf("template loader not configured for extends directive")
-	}
-
-	// Get the parent template name from extends expression
-	parentName := strings.Trim(extendsNode.Expression, "'\"")
-
-	// Load parent template
-	parentContent, err := t.loader(parentName)
-	if err != nil {
-		return "", fmt.Errorf("failed to load parent template '%s': %v", parentName, err)
-	}
-
-	// Parse parent template
-	parentTokens := t.tokenize(parentContent)
-	parentTree := t.createSyntaxTree(parentTokens)
-
-	// Collect blocks from child template
-	childBlocks := t.collectBlocks(childTree)
-
-	// Render parent with child blocks overriding
-	return t.renderWithBlocks(parentTree, childBlocks, data, filters)
-}
-
 // collectBlocks extracts all block definitions from a template tree
 func (t *Template) collectBlocks(tree *TreeNode) map[string]*TreeNode {
 	blocks := make(map[string]*TreeNode)
@@ -63,12 +37,12 @@ func (t *Template) collectBlocks(tree *TreeNode) map[string]*TreeNode {
 	return blocks
 }
 
-// renderWithBlocks renders a tree with block overrides
-func (t *Template) renderWithBlocks(tree *TreeNode, blockOverrides map[string]*TreeNode, data map[string]any, filters map[string]any) (string, error) {
-	result := ""
-	ifNodes := []*TreeNode{}
+// renderWithBlocks renders a tree with block overrides to the writer
+func (t *Template) renderWithBlocks(w io.Writer, tree *TreeNode, blockOverrides map[string]*TreeNode, data map[string]any, ctx *renderContext) error {
+	chain := ifChain{}
 
 	for i, child := range tree.Children {
+		var err error
 		switch child.Type {
 		case "block":
 			// Check if this block is overridden
@@ -88,74 +62,57 @@ func (t *Template) renderWithBlocks(tree *TreeNode, blockOverrides map[string]*T
 				}
 			}
 
+			// Variables set in a block are local to the block
 			if override, exists := blockOverrides[blockName]; exists {
 				// Add preceding whitespace before override content
-				result += precedingWhitespace
-				// Render the override block (with block overrides for nested blocks)
-				output, err := t.renderWithBlocks(override, blockOverrides, data, filters)
-				if err != nil {
-					return "", err
+				if _, err = io.WriteString(w, precedingWhitespace); err == nil {
+					// Render the override block (with block overrides for nested blocks)
+					err = t.renderWithBlocks(w, override, blockOverrides, copyMap(data), ctx)
 				}
-				result += output
 			} else {
 				// Render the default block content (with block overrides for nested blocks)
-				output, err := t.renderWithBlocks(child, blockOverrides, data, filters)
-				if err != nil {
-					return "", err
-				}
-				result += output
+				err = t.renderWithBlocks(w, child, blockOverrides, copyMap(data), ctx)
 			}
-			ifNodes = []*TreeNode{}
+			chain = ifChain{}
 		case "if":
-			output, err := t.renderIfNode(child, data, filters)
-			if err != nil {
-				return "", err
-			}
-			result += output
-			ifNodes = []*TreeNode{child}
+			err = t.renderIfNode(w, child, &chain, data, ctx)
 		case "elseif":
-			output, err := t.renderElseIfNode(child, ifNodes, data, filters)
-			if err != nil {
-				return "", err
-			}
-			result += output
-			ifNodes = append(ifNodes, child)
+			err = t.renderElseIfNode(w, child, &chain, data, ctx)
 		case "else":
-			output, err := t.renderElseNode(child, ifNodes, data, filters)
-			if err != nil {
-				return "", err
-			}
-			result += output
-			ifNodes = []*TreeNode{}
+			err = t.renderElseNode(w, child, &chain, data, ctx)
+			chain = ifChain{}
 		case "for":
-			output, err := t.renderForNode(child, data, filters)
-			if err != nil {
-				return "", err
-			}
-			result += output
-			ifNodes = []*TreeNode{}
+			err = t.renderForNode(w, child, data, ctx)
+			chain = ifChain{}
 		case "var":
-			output, err := t.renderVarNode(child, data, filters)
-			if err != nil {
-				return "", err
-			}
-			result += output
-			ifNodes = []*TreeNode{}
+			err = t.renderVarNode(w, child, data, ctx)
+			chain = ifChain{}
+		case "include":
+			err = t.renderIncludeNode(w, child, data, ctx)
+			chain = ifChain{}
+		case "set":
+			err = t.renderSetNode(w, child, data, ctx)
+			chain = ifChain{}
+		case "with":
+			err = t.renderWithNode(w, child, data, ctx)
+			chain = ifChain{}
 		case "lit":
+			chain = ifChain{}
 			// Skip this literal if it's preceding whitespace for a block
 			// (it's already been handled as part of the block rendering)
 			if i+1 < len(tree.Children) && tree.Children[i+1].Type == "block" {
 				// Check if this literal is whitespace-only without newlines
 				if strings.TrimSpace(child.Expression) == "" && !strings.Contains(child.Expression, "\n") && !strings.Contains(child.Expression, "\r") {
 					// This will be included with the block, so skip it here
-					ifNodes = []*TreeNode{}
 					continue
 				}
 			}
-			result += child.Expression
-			ifNodes = []*TreeNode{}
+			_, err = io.WriteString(w, child.Expression)
+		}
+		if err != nil {
+			return err
 		}
 	}
 
-	return result, nil
+	return nil
 }
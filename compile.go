@@ -0,0 +1,572 @@
+package tqtemplate
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// forHeaderRegexp parses "for key, value in array" or "for value in array"
+var forHeaderRegexp = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*(?:\s*,\s*[a-zA-Z_][a-zA-Z0-9_]*)?)\s+in\s+(.+)$`)
+
+// forRecursiveRegexp matches the "recursive" modifier at the end of a for header
+var forRecursiveRegexp = regexp.MustCompile(`\s+recursive$`)
+
+// loopCallRegexp parses a "loop(items)" call in a recursive loop
+var loopCallRegexp = regexp.MustCompile(`^loop\s*\((.*)\)$`)
+
+// setAssignRegexp parses "name = expression" of a set tag
+var setAssignRegexp = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*)\s*=([^=].*)$`)
+
+// identifierRegexp matches a variable name
+var identifierRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// filterArg is a pre-parsed filter argument, either a literal value or an
+// expression
+type filterArg struct {
+	value any
+	expr  *Expression
+}
+
+// filterCall is a pre-parsed filter invocation in a filter chain
+type filterCall struct {
+	name string
+	args []filterArg
+}
+
+// CompiledTemplate is a parsed template that can be rendered many times,
+// also concurrently from multiple goroutines
+type CompiledTemplate struct {
+	engine  *Template
+	name    string
+	tree    *TreeNode
+	parent  *TreeNode
+	blocks  map[string]*TreeNode
+	filters map[string]any
+}
+
+// compiler holds the state of a single compilation
+type compiler struct {
+	t        *Template
+	includes map[string]*TreeNode
+}
+
+// Compile parses a template string into a reusable compiled template
+func (t *Template) Compile(template string) (*CompiledTemplate, error) {
+	return t.compile("", template)
+}
+
+// CompileFile loads a template file and parses it into a reusable compiled template
+func (t *Template) CompileFile(templateFile string) (*CompiledTemplate, error) {
+	if t.loader == nil {
+		return nil, fmt.Errorf("no template loader defined")
+	}
+	templateContent, err := t.loader(templateFile)
+	if err != nil {
+		return nil, err
+	}
+	return t.compile(templateFile, templateContent)
+}
+
+// compile parses the template and prepares all nodes for rendering. The
+// template is compiled and rendered with a snapshot of the engine, so that
+// changing the engine does not affect templates that are being rendered.
+func (t *Template) compile(name, template string) (*CompiledTemplate, error) {
+	t = t.snapshot()
+	c := &compiler{t: t, includes: make(map[string]*TreeNode)}
+	tree, err := c.parse(name, template)
+	if err != nil {
+		return nil, err
+	}
+	compiled := &CompiledTemplate{
+		engine:  t,
+		name:    name,
+		tree:    tree,
+		filters: t.getFilters(),
+	}
+
+	// Check if this template extends another template
+	// Extends must be the first non-literal node
+	extendsNode := t.findExtendsNode(compiled.tree)
+	if extendsNode != nil {
+		if t.loader == nil {
+			return nil, fmt.Errorf("template loader not configured for extends directive")
+		}
+
+		// Get the parent template name from extends expression
+		parentName := strings.Trim(extendsNode.Expression, "'\"")
+
+		// Load parent template
+		parentContent, err := t.loader(parentName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load parent template '%s': %v", parentName, err)
+		}
+
+		compiled.parent, err = c.parse(parentName, parentContent)
+		if err != nil {
+			return nil, err
+		}
+		compiled.blocks = t.collectBlocks(compiled.tree)
+	}
+
+	return compiled, nil
+}
+
+// Name returns the name the template was compiled from (empty for strings)
+func (ct *CompiledTemplate) Name() string {
+	return ct.name
+}
+
+// Render renders the compiled template with the provided data
+func (ct *CompiledTemplate) Render(data map[string]any) (string, error) {
+	var sb strings.Builder
+	if err := ct.RenderTo(&sb, data); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// RenderTo renders the compiled template with the provided data to a writer
+func (ct *CompiledTemplate) RenderTo(w io.Writer, data map[string]any) error {
+	return ct.render(w, data)
+}
+
+// RenderAny renders the compiled template with data that is a struct, a
+// pointer to a struct or a map with string keys
+func (ct *CompiledTemplate) RenderAny(data any) (string, error) {
+	var sb strings.Builder
+	if err := ct.RenderAnyTo(&sb, data); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// RenderAnyTo renders the compiled template with data that is a struct, a
+// pointer to a struct or a map with string keys to a writer
+func (ct *CompiledTemplate) RenderAnyTo(w io.Writer, data any) error {
+	return ct.render(w, data)
+}
+
+// render renders the compiled template with the root data to a writer
+func (ct *CompiledTemplate) render(w io.Writer, root any) error {
+	t := ct.engine
+	ctx := &renderContext{filters: ct.filters}
+	if t.maxOutputSize > 0 {
+		w = &limitWriter{w: w, remaining: t.maxOutputSize, max: t.maxOutputSize}
+	}
+
+	data, err := t.newScope(root)
+	if err != nil {
+		return err
+	}
+
+	if ct.parent != nil {
+		// Variables set at the top level of the child are visible in all blocks
+		for _, child := range ct.tree.Children {
+			if child.Type == "set" {
+				if err := t.renderSetNode(io.Discard, child, data, ctx); err != nil {
+					return err
+				}
+			}
+		}
+		// Render parent with child blocks overriding
+		return t.renderWithBlocks(w, ct.parent, ct.blocks, data, ctx)
+	}
+	return t.renderChildren(w, ct.tree, data, ctx)
+}
+
+// rootKey is the key of the scope that holds root data that is not a map,
+// it can not be used as a variable name in templates
+const rootKey = "\x00root"
+
+// newScope creates the top level scope of a render. Globals are available in
+// every template, unless overridden by the data. The scope is a new map, so
+// the data is not modified. The fields of struct data are resolved when they
+// are used, as they are in paths.
+func (t *Template) newScope(root any) (map[string]any, error) {
+	data, isMap := root.(map[string]any)
+	if !isMap && root != nil {
+		v := reflect.ValueOf(root)
+		for v.Kind() == reflect.Pointer && !v.IsNil() {
+			v = v.Elem()
+		}
+		switch {
+		case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+			data = make(map[string]any, v.Len())
+			iter := v.MapRange()
+			for iter.Next() {
+				data[iter.Key().String()] = normalizeValue(iter.Value().Interface())
+			}
+		case v.Kind() == reflect.Struct:
+			data = map[string]any{rootKey: root}
+		default:
+			return nil, fmt.Errorf("data must be a map with string keys or a struct, not %T", root)
+		}
+	}
+
+	t.mu.RLock()
+	scope := make(map[string]any, len(t.globals)+len(data))
+	for k, v := range t.globals {
+		if _, exists, _ := lookupField(data[rootKey], k); !exists {
+			scope[k] = v
+		}
+	}
+	t.mu.RUnlock()
+	for k, v := range data {
+		scope[k] = v
+	}
+	return scope, nil
+}
+
+// limitWriter is a writer that fails when the output exceeds a maximum size
+type limitWriter struct {
+	w         io.Writer
+	remaining int
+	max       int
+}
+
+// Write writes to the underlying writer while the size limit is not exceeded
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	if len(p) > lw.remaining {
+		return 0, fmt.Errorf("output exceeds maximum size of %d bytes", lw.max)
+	}
+	lw.remaining -= len(p)
+	return lw.w.Write(p)
+}
+
+// getFilters merges builtin and custom filters and tests into one map
+func (t *Template) getFilters() map[string]any {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	filters := make(map[string]any)
+
+	// Register all builtin filters
+	builtins := getBuiltinFilters()
+	for name, fn := range builtins {
+		filters[name] = fn
+	}
+
+	// Collect all tests (builtin + custom)
+	allTests := make(map[string]any)
+
+	// Register all builtin tests
+	tests := getBuiltinTests()
+	for name, fn := range tests {
+		allTests[name] = fn
+		filters[name] = fn
+	}
+
+	// Add custom tests (allow user overrides)
+	for name, fn := range t.tests {
+		allTests[name] = fn
+		filters[name] = fn
+	}
+
+	// Create __istest__ and __isnot__ filters with access to all tests
+	filters["__istest__"] = createFilterIsTest(allTests)
+	filters["__isnot__"] = createFilterIsNot(allTests)
+
+	// Add custom filters (allow user overrides)
+	for name, fn := range t.filters {
+		filters[name] = fn
+	}
+
+	return filters
+}
+
+// parse tokenizes a template, builds the syntax tree and prepares its nodes
+func (c *compiler) parse(name, template string) (*TreeNode, error) {
+	tree, err := c.parseTree(name, template)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.prepare(tree); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// parseTree tokenizes a template and builds the syntax tree
+func (c *compiler) parseTree(name, template string) (*TreeNode, error) {
+	src := &source{name: name, text: template}
+	tokens, err := c.t.tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	return c.t.createSyntaxTree(src, tokens)
+}
+
+// prepare pre-parses the expressions of a node and all its descendants
+func (c *compiler) prepare(node *TreeNode) error {
+	switch node.Type {
+	case "var":
+		if matches := loopCallRegexp.FindStringSubmatch(node.Expression); matches != nil {
+			node.recurse = true
+			node.expr, node.chain = c.parseExpression(matches[1])
+		} else {
+			c.prepareExpression(node)
+		}
+	case "if", "elseif":
+		c.prepareExpression(node)
+	case "break", "continue":
+		if node.Expression != "" {
+			c.prepareExpression(node)
+		}
+	case "for":
+		if err := c.prepareFor(node); err != nil {
+			return err
+		}
+	case "set":
+		if err := c.prepareSet(node); err != nil {
+			return err
+		}
+	case "with":
+		if err := c.prepareWith(node); err != nil {
+			return err
+		}
+	case "include":
+		var err error
+		node.include, err = c.compileInclude(strings.Trim(node.Expression, "'\""))
+		var templateErr *TemplateError
+		if errors.As(err, &templateErr) {
+			return err
+		}
+		// Loading errors are reported when the include is rendered
+		node.err = err
+	}
+	for _, child := range node.Children {
+		if err := c.prepare(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareExpression pre-parses an expression with its filter chain and "is" test
+func (c *compiler) prepareExpression(node *TreeNode) {
+	node.expr, node.chain = c.parseExpression(node.Expression)
+}
+
+// parseExpression parses an expression with its filter chain and "is" test
+func (c *compiler) parseExpression(expression string) (*Expression, []filterCall) {
+	// Preprocess "is" tests
+	exprPart, testFilter := processIsTests(expression)
+
+	parts := c.t.explodeRespectingQuotes("|", exprPart, -1)
+	actualExpr := parts[0]
+	filterParts := parts[1:]
+
+	// Add test filter if present
+	if testFilter != "" {
+		filterParts = append(filterParts, testFilter)
+	}
+
+	return NewExpression(actualExpr), c.t.parseFilterChain(filterParts)
+}
+
+// prepareFor pre-parses the header of a 'for' loop node
+func (c *compiler) prepareFor(node *TreeNode) error {
+	matches := forHeaderRegexp.FindStringSubmatch(node.Expression)
+	if matches == nil {
+		return node.src.errorAt(node.pos, `invalid for syntax, expected "item in array" or "key, value in array"`)
+	}
+
+	vars := matches[1]
+	arrayExpr := matches[2]
+
+	// Check if we have "key, value" or just "value"
+	if strings.Contains(vars, ",") {
+		varParts := strings.Split(vars, ",")
+		node.forKey = strings.TrimSpace(varParts[0])
+		node.forValue = strings.TrimSpace(varParts[1])
+	} else {
+		node.forValue = strings.TrimSpace(vars)
+	}
+
+	// Check for "recursive" and an "if" condition after the array expression
+	if loc := forRecursiveRegexp.FindStringIndex(arrayExpr); loc != nil {
+		node.recursive = true
+		arrayExpr = arrayExpr[:loc[0]]
+	}
+	arrayExpr, condition := splitForCondition(arrayExpr)
+	if condition != "" {
+		node.forCond = &TreeNode{Type: "if", Expression: condition, src: node.src, pos: node.pos}
+		c.prepareExpression(node.forCond)
+	}
+
+	// Parse filters from array expression
+	parts := c.t.explodeRespectingQuotes("|", arrayExpr, -1)
+	node.expr = NewExpression(parts[0])
+	node.chain = c.t.parseFilterChain(parts[1:])
+	return nil
+}
+
+// splitForCondition splits "array if condition" on the first "if" keyword
+// that is not within quotes
+func splitForCondition(str string) (string, string) {
+	quoted := false
+	escaped := false
+	for i := 0; i < len(str); i++ {
+		switch ch := str[i]; {
+		case escaped:
+			escaped = false
+		case quoted:
+			if ch == '\\' {
+				escaped = true
+			} else if ch == '"' {
+				quoted = false
+			}
+		case ch == '"':
+			quoted = true
+		case ch == ' ' || ch == '\t':
+			rest := str[i+1:]
+			if strings.HasPrefix(rest, "if") && len(rest) > 2 && (rest[2] == ' ' || rest[2] == '\t') {
+				return strings.TrimSpace(str[:i]), strings.TrimSpace(rest[2:])
+			}
+		}
+	}
+	return str, ""
+}
+
+// prepareSet pre-parses a 'set' node, either "name = expression" or the
+// capturing form "name" with optional filters that are applied to the content
+func (c *compiler) prepareSet(node *TreeNode) error {
+	if matches := setAssignRegexp.FindStringSubmatch(node.Expression); matches != nil {
+		node.target = matches[1]
+		node.expr, node.chain = c.parseExpression(strings.TrimSpace(matches[2]))
+		return nil
+	}
+
+	parts := c.t.explodeRespectingQuotes("|", node.Expression, -1)
+	node.target = strings.TrimSpace(parts[0])
+	if !identifierRegexp.MatchString(node.target) {
+		return node.src.errorAt(node.pos, `invalid set syntax, expected "name = expression" or "name"`)
+	}
+	node.chain = c.t.parseFilterChain(parts[1:])
+	return nil
+}
+
+// prepareWith pre-parses the comma separated "name = expression" assignments
+// of a 'with' node into 'set' nodes
+func (c *compiler) prepareWith(node *TreeNode) error {
+	if node.Expression == "" {
+		return nil
+	}
+	for _, part := range splitArguments(node.Expression) {
+		matches := setAssignRegexp.FindStringSubmatch(strings.TrimSpace(part))
+		if matches == nil {
+			return node.src.errorAt(node.pos, `invalid with syntax, expected "name = expression, ..."`)
+		}
+		assign := &TreeNode{Type: "set", Expression: node.Expression, src: node.src, pos: node.pos, target: matches[1]}
+		assign.expr, assign.chain = c.parseExpression(strings.TrimSpace(matches[2]))
+		node.assigns = append(node.assigns, assign)
+	}
+	return nil
+}
+
+// splitArguments splits a string on commas that are not within quotes or parentheses
+func splitArguments(str string) []string {
+	parts := []string{}
+	depth := 0
+	quoted := false
+	escaped := false
+	start := 0
+	for i := 0; i < len(str); i++ {
+		switch ch := str[i]; {
+		case escaped:
+			escaped = false
+		case quoted:
+			if ch == '\\' {
+				escaped = true
+			} else if ch == '"' {
+				quoted = false
+			}
+		case ch == '"':
+			quoted = true
+		case ch == '(':
+			depth++
+		case ch == ')':
+			depth--
+		case ch == ',' && depth == 0:
+			parts = append(parts, str[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, str[start:])
+}
+
+// compileInclude loads and parses an included template once per compilation
+func (c *compiler) compileInclude(name string) (*TreeNode, error) {
+	if tree, exists := c.includes[name]; exists {
+		return tree, nil
+	}
+	if c.t.loader == nil {
+		return nil, fmt.Errorf("template loader not configured for include directive")
+	}
+
+	// Load the included template
+	templateContent, err := c.t.loader(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load included template '%s': %v", name, err)
+	}
+
+	// Register before preparing so recursive includes share the tree
+	tree, err := c.parseTree(name, templateContent)
+	if err != nil {
+		return nil, err
+	}
+	c.includes[name] = tree
+	if err := c.prepare(tree); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// parseFilterChain parses filter expressions like name("arg", items[0]) into calls
+func (t *Template) parseFilterChain(parts []string) []filterCall {
+	chain := []filterCall{}
+	for _, part := range parts {
+		funcParts := t.explodeRespectingQuotes("(", strings.TrimSuffix(part, ")"), 2)
+		call := filterCall{name: funcParts[0]}
+
+		if len(funcParts) > 1 {
+			argStrs := splitArguments(funcParts[1])
+			for _, argStr := range argStrs {
+				argStr = strings.TrimSpace(argStr)
+				argLen := len(argStr)
+				if argLen > 1 && argStr[0] == '"' && argStr[argLen-1] == '"' {
+					// String literal - unescape
+					unescaped := argStr[1 : argLen-1]
+					unescaped = strings.ReplaceAll(unescaped, "\\n", "\n")
+					unescaped = strings.ReplaceAll(unescaped, "\\t", "\t")
+					unescaped = strings.ReplaceAll(unescaped, "\\\"", "\"")
+					unescaped = strings.ReplaceAll(unescaped, "\\\\", "\\")
+					call.args = append(call.args, filterArg{value: unescaped})
+				} else if argStr == "true" {
+					// Boolean literal - true
+					call.args = append(call.args, filterArg{value: true})
+				} else if argStr == "false" {
+					// Boolean literal - false
+					call.args = append(call.args, filterArg{value: false})
+				} else if num, err := strconv.ParseFloat(argStr, 64); err == nil {
+					// Numeric literal - convert to appropriate numeric type
+					if strings.Contains(argStr, ".") {
+						call.args = append(call.args, filterArg{value: num}) // float64
+					} else {
+						call.args = append(call.args, filterArg{value: int(num)}) // int
+					}
+				} else {
+					// Expression, such as a path or a subscript
+					call.args = append(call.args, filterArg{expr: NewExpression(argStr)})
+				}
+			}
+		}
+
+		chain = append(chain, call)
+	}
+	return chain
+}
@@ -0,0 +1,127 @@
+package tqtemplate
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// TemplateError is an error at a specific location in a template
+type TemplateError struct {
+	Name    string // template name, empty for template strings
+	Line    int    // 1-based line number
+	Column  int    // 1-based column number (in characters)
+	Message string
+	Snippet string // source line with a caret marking the column
+}
+
+// Error returns the error formatted as "name:line:column: message"
+func (e *TemplateError) Error() string {
+	name := e.Name
+	if name == "" {
+		name = "template"
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", name, e.Line, e.Column, e.Message)
+}
+
+// TemplateErrors is a list of errors found while parsing a template
+type TemplateErrors []*TemplateError
+
+// Error returns all errors, one per line
+func (errs TemplateErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Unwrap returns the individual errors for use with errors.Is and errors.As
+func (errs TemplateErrors) Unwrap() []error {
+	list := make([]error, len(errs))
+	for i, err := range errs {
+		list[i] = err
+	}
+	return list
+}
+
+// RenderError is an error evaluating a tag while rendering a template
+type RenderError struct {
+	Name       string // template name, empty for template strings
+	Line       int    // 1-based line number of the tag
+	Column     int    // 1-based column number of the tag
+	Tag        string // tag type: "var", "if", "elseif", "for", "include", "set", "with", "break" or "continue"
+	Expression string // expression of the tag
+	Err        error  // the underlying error
+
+	delimiters Delimiters // delimiters of the engine, used to quote the tag
+}
+
+// Error returns the error formatted as "name:line:column: message"
+func (e *RenderError) Error() string {
+	name := e.Name
+	if name == "" {
+		name = "template"
+	}
+	d := e.delimiters.withDefaults()
+	tag := d.BlockStart + " " + e.Tag + " " + e.Expression + " " + d.BlockEnd
+	if e.Tag == "var" {
+		tag = d.VariableStart + " " + e.Expression + " " + d.VariableEnd
+	}
+	return fmt.Sprintf("%s:%d:%d: error in `%s`: %v", name, e.Line, e.Column, tag, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *RenderError) Unwrap() error {
+	return e.Err
+}
+
+// source is the text of a template with its name, used to locate errors
+type source struct {
+	name string
+	text string
+}
+
+// errorAt creates a TemplateError for a byte offset in the source
+func (s *source) errorAt(pos int, format string, args ...any) *TemplateError {
+	if pos > len(s.text) {
+		pos = len(s.text)
+	}
+	lineStart := strings.LastIndex(s.text[:pos], "\n") + 1
+	lineEnd := strings.IndexByte(s.text[pos:], '\n')
+	if lineEnd == -1 {
+		lineEnd = len(s.text)
+	} else {
+		lineEnd += pos
+	}
+	line := strings.TrimRight(s.text[lineStart:lineEnd], "\r")
+
+	// Keep tabs in the caret line so it lines up with the source line
+	caret := ""
+	for _, r := range s.text[lineStart:pos] {
+		if r == '\t' {
+			caret += "\t"
+		} else {
+			caret += " "
+		}
+	}
+
+	return &TemplateError{
+		Name:    s.name,
+		Line:    s.lineAt(pos),
+		Column:  s.columnAt(pos),
+		Message: fmt.Sprintf(format, args...),
+		Snippet: line + "\n" + caret + "^",
+	}
+}
+
+// columnAt returns the 1-based column (in characters) of a byte offset in the source
+func (s *source) columnAt(pos int) int {
+	lineStart := strings.LastIndex(s.text[:pos], "\n") + 1
+	return utf8.RuneCountInString(s.text[lineStart:pos]) + 1
+}
+
+// lineAt returns the 1-based line number of a byte offset in the source
+func (s *source) lineAt(pos int) int {
+	return strings.Count(s.text[:pos], "\n") + 1
+}
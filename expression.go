@@ -2,6 +2,7 @@ package tqtemplate
 
 import (
 	"fmt"
+	"reflect"
 	"strconv"
 	"strings"
 	"unicode"
@@ -10,13 +11,14 @@ import (
 
 // ExpressionToken represents a token in an expression
 type ExpressionToken struct {
-	Type  string // "number", "string", "identifier", "operator", "parenthesis"
+	Type  string // "number", "string", "identifier", "operator", "parenthesis", "bracket", "colon", "call", "comma"
 	Value string
 }
 
 // Expression represents a parsed expression with operators
 type Expression struct {
 	tokens []ExpressionToken
+	rpn    []ExpressionToken
 }
 
 type operator struct {
@@ -47,6 +49,7 @@ var operators = map[string]operator{
 func NewExpression(expr string) *Expression {
 	e := &Expression{}
 	e.tokens = e.tokenize(expr)
+	e.rpn = e.toReversePolishNotation()
 	return e
 }
 
@@ -67,6 +70,18 @@ func (e *Expression) tokenize(expr string) []ExpressionToken {
 			continue
 		}
 
+		// Handle function calls, as in "loop.cycle(a, b)"
+		if ch == '(' && len(tokens) > 0 && (tokens[len(tokens)-1].Type == "identifier" || tokens[len(tokens)-1].Value == "]") {
+			tokens = append(tokens, ExpressionToken{Type: "call", Value: "("})
+			i += chSize
+			continue
+		}
+		if ch == ',' {
+			tokens = append(tokens, ExpressionToken{Type: "comma", Value: ","})
+			i += chSize
+			continue
+		}
+
 		// Handle parentheses
 		if ch == '(' || ch == ')' {
 			tokens = append(tokens, ExpressionToken{Type: "parenthesis", Value: string(ch)})
@@ -74,6 +89,43 @@ func (e *Expression) tokenize(expr string) []ExpressionToken {
 			continue
 		}
 
+		// Handle subscripts and slices
+		if ch == '[' || ch == ']' {
+			tokens = append(tokens, ExpressionToken{Type: "bracket", Value: string(ch)})
+			i += chSize
+			continue
+		}
+		if ch == ':' {
+			tokens = append(tokens, ExpressionToken{Type: "colon", Value: ":"})
+			i += chSize
+			continue
+		}
+
+		// Handle dot-notation after a subscript or parentheses, as in
+		// "items[0].name", by adding a subscript for each part
+		if ch == '.' && len(tokens) > 0 && (tokens[len(tokens)-1].Value == "]" || tokens[len(tokens)-1].Value == ")") {
+			start := i + chSize
+			i = start
+			for i < length {
+				r, size := utf8.DecodeRuneInString(expr[i:])
+				if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' {
+					i += size
+				} else {
+					break
+				}
+			}
+			for _, part := range strings.Split(expr[start:i], ".") {
+				key := ExpressionToken{Type: "string", Value: part}
+				if _, err := strconv.Atoi(part); err == nil {
+					key.Type = "number"
+				}
+				tokens = append(tokens,
+					ExpressionToken{Type: "bracket", Value: "["}, key,
+					ExpressionToken{Type: "bracket", Value: "]"})
+			}
+			continue
+		}
+
 		// Handle word-based operators (and, or, not) - only ASCII letters
 		if ch < utf8.RuneSelf && unicode.IsLetter(ch) {
 			word := ""
@@ -95,8 +147,25 @@ func (e *Expression) tokenize(expr string) []ExpressionToken {
 			i = start
 		}
 
-		// Handle two-character operators
-		if i < length-1 {
+		// Handle negative numbers where a minus can not be an operator
+		if ch == '-' && i < length-1 && unicode.IsDigit(rune(expr[i+1])) && !followsOperand(tokens) {
+			num := "-"
+			i += chSize
+			for i < length {
+				r, size := utf8.DecodeRuneInString(expr[i:])
+				if unicode.IsDigit(r) || r == '.' {
+					num += string(r)
+					i += size
+				} else {
+					break
+				}
+			}
+			tokens = append(tokens, ExpressionToken{Type: "number", Value: num})
+			continue
+		}
+
+		// Handle two-character operators (word operators are handled above)
+		if i < length-1 && !unicode.IsLetter(ch) {
 			twoChar := expr[i : i+2]
 			if _, exists := operators[twoChar]; exists {
 				tokens = append(tokens, ExpressionToken{Type: "operator", Value: twoChar})
@@ -177,10 +246,31 @@ func (e *Expression) tokenize(expr string) []ExpressionToken {
 	return tokens
 }
 
+// followsOperand returns whether the last token ends an operand, so that a
+// next minus is the subtraction operator
+func followsOperand(tokens []ExpressionToken) bool {
+	if len(tokens) == 0 {
+		return false
+	}
+	last := tokens[len(tokens)-1]
+	switch last.Type {
+	case "number", "string", "identifier":
+		return true
+	case "parenthesis", "bracket":
+		return last.Value == ")" || last.Value == "]"
+	}
+	return false
+}
+
 // Evaluate evaluates the expression with the given data context
 func (e *Expression) Evaluate(data map[string]any, resolvePath func(string, map[string]any) (any, error)) (any, error) {
-	rpn := e.toReversePolishNotation()
-	return e.evaluateRPN(rpn, data, resolvePath)
+	return e.evaluateRPN(e.rpn, data, resolvePath, UndefinedStrict)
+}
+
+// evaluate evaluates the expression with the path resolution and undefined
+// policy of a template
+func (e *Expression) evaluate(data map[string]any, t *Template) (any, error) {
+	return e.evaluateRPN(e.rpn, data, t.resolvePath, t.undefinedPolicy)
 }
 
 // toReversePolishNotation converts infix notation to RPN using Shunting Yard algorithm
@@ -188,24 +278,87 @@ func (e *Expression) toReversePolishNotation() []ExpressionToken {
 	output := []ExpressionToken{}
 	operatorStack := []ExpressionToken{}
 
-	for _, token := range e.tokens {
+	for i, token := range e.tokens {
+		var prev ExpressionToken
+		if i > 0 {
+			prev = e.tokens[i-1]
+		}
 		if token.Type == "number" || token.Type == "string" || token.Type == "identifier" {
 			// Operand
 			output = append(output, token)
+		} else if token.Type == "bracket" && token.Value == "[" {
+			// The bracket marks the start of the subscript on the operator stack
+			operatorStack = append(operatorStack, token)
+		} else if token.Type == "colon" || (token.Type == "bracket" && token.Value == "]") {
+			// Pop operators until we find the matching '['
+			for len(operatorStack) > 0 {
+				top := operatorStack[len(operatorStack)-1]
+				if top.Type == "bracket" {
+					break
+				}
+				output = append(output, top)
+				operatorStack = operatorStack[:len(operatorStack)-1]
+			}
+			if len(operatorStack) == 0 {
+				output = append(output, ExpressionToken{Type: "invalid", Value: token.Value})
+				continue
+			}
+			// A missing slice bound is a "none" operand
+			if token.Type == "colon" {
+				if prev.Type == "bracket" && prev.Value == "[" {
+					output = append(output, ExpressionToken{Type: "none"})
+				}
+				operatorStack[len(operatorStack)-1].Value = "[:"
+				continue
+			}
+			if prev.Type == "colon" {
+				output = append(output, ExpressionToken{Type: "none"})
+			}
+			if operatorStack[len(operatorStack)-1].Value == "[:" {
+				output = append(output, ExpressionToken{Type: "subscript", Value: "slice"})
+			} else {
+				output = append(output, ExpressionToken{Type: "subscript", Value: "index"})
+			}
+			operatorStack = operatorStack[:len(operatorStack)-1]
+		} else if token.Type == "call" {
+			// The call marks the start of the arguments, counting the commas
+			operatorStack = append(operatorStack, ExpressionToken{Type: "call", Value: "0"})
+		} else if token.Type == "comma" {
+			// Pop operators until we find the call the argument belongs to
+			for len(operatorStack) > 0 && operatorStack[len(operatorStack)-1].Type == "operator" {
+				output = append(output, operatorStack[len(operatorStack)-1])
+				operatorStack = operatorStack[:len(operatorStack)-1]
+			}
+			if len(operatorStack) > 0 && operatorStack[len(operatorStack)-1].Type == "call" {
+				commas, _ := strconv.Atoi(operatorStack[len(operatorStack)-1].Value)
+				operatorStack[len(operatorStack)-1].Value = strconv.Itoa(commas + 1)
+			}
 		} else if token.Type == "parenthesis" && token.Value == "(" {
 			operatorStack = append(operatorStack, token)
 		} else if token.Type == "parenthesis" && token.Value == ")" {
-			// Pop operators until we find the matching '('
+			// Pop operators until we find the matching '(' or call
 			for len(operatorStack) > 0 {
 				top := operatorStack[len(operatorStack)-1]
-				if top.Type == "parenthesis" && top.Value == "(" {
+				if (top.Type == "parenthesis" && top.Value == "(") || top.Type == "call" {
 					break
 				}
 				output = append(output, top)
 				operatorStack = operatorStack[:len(operatorStack)-1]
 			}
 			if len(operatorStack) > 0 {
-				operatorStack = operatorStack[:len(operatorStack)-1] // Remove the '('
+				top := operatorStack[len(operatorStack)-1]
+				if top.Type == "call" {
+					// The number of arguments is the number of commas plus one
+					args := 0
+					if prev.Type != "call" {
+						commas, _ := strconv.Atoi(top.Value)
+						args = commas + 1
+					}
+					output = append(output, ExpressionToken{Type: "call", Value: strconv.Itoa(args)})
+				}
+				operatorStack = operatorStack[:len(operatorStack)-1] // Remove the '(' or call
+			} else {
+				output = append(output, ExpressionToken{Type: "invalid", Value: token.Value})
 			}
 		} else if token.Type == "operator" {
 			o1 := token.Value
@@ -234,39 +387,94 @@ func (e *Expression) toReversePolishNotation() []ExpressionToken {
 		}
 	}
 
-	// Pop remaining operators
+	// Pop remaining operators, an opening bracket or call is not closed
 	for len(operatorStack) > 0 {
-		output = append(output, operatorStack[len(operatorStack)-1])
+		top := operatorStack[len(operatorStack)-1]
+		switch top.Type {
+		case "parenthesis", "bracket":
+			top = ExpressionToken{Type: "invalid", Value: top.Value[:1]}
+		case "call":
+			top = ExpressionToken{Type: "invalid", Value: "("}
+		}
+		output = append(output, top)
 		operatorStack = operatorStack[:len(operatorStack)-1]
 	}
 
 	return output
 }
 
+// operand is a value on the evaluation stack, with the text it was
+// evaluated from when it is a path, for use in error messages
+type operand struct {
+	value any
+	name  string
+}
+
 // evaluateRPN evaluates an expression in Reverse Polish Notation
-func (e *Expression) evaluateRPN(rpn []ExpressionToken, data map[string]any, resolvePath func(string, map[string]any) (any, error)) (any, error) {
-	stack := []any{}
+func (e *Expression) evaluateRPN(rpn []ExpressionToken, data map[string]any, resolvePath func(string, map[string]any) (any, error), policy UndefinedPolicy) (any, error) {
+	stack := []operand{}
 
 	for _, token := range rpn {
-		if token.Type == "number" || token.Type == "string" || token.Type == "identifier" {
+		if token.Type == "number" || token.Type == "string" || token.Type == "identifier" || token.Type == "none" {
 			// Operand
 			if token.Type == "number" {
 				if strings.Contains(token.Value, ".") {
 					val, _ := strconv.ParseFloat(token.Value, 64)
-					stack = append(stack, val)
+					stack = append(stack, operand{value: val})
 				} else {
 					val, _ := strconv.Atoi(token.Value)
-					stack = append(stack, val)
+					stack = append(stack, operand{value: val})
 				}
 			} else if token.Type == "string" {
-				stack = append(stack, token.Value)
+				stack = append(stack, operand{value: token.Value})
 			} else if token.Type == "identifier" {
 				val, err := resolvePath(token.Value, data)
 				if err != nil {
 					return nil, err
 				}
-				stack = append(stack, val)
+				stack = append(stack, operand{value: val, name: token.Value})
+			} else {
+				stack = append(stack, operand{})
+			}
+		} else if token.Type == "invalid" {
+			return nil, fmt.Errorf("malformed expression, unmatched `%s`", token.Value)
+		} else if token.Type == "call" {
+			// Postfix operator with the function and its arguments
+			count, _ := strconv.Atoi(token.Value)
+			if len(stack) < count+1 {
+				return nil, fmt.Errorf("not enough operands for '()'")
+			}
+			fn := stack[len(stack)-count-1]
+			args := make([]any, count)
+			for i, arg := range stack[len(stack)-count:] {
+				value, err := definedValue(arg.value)
+				if err != nil {
+					return nil, err
+				}
+				args[i] = value
 			}
+			stack = stack[:len(stack)-count-1]
+			result, err := e.applyCall(fn, args)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, operand{value: result})
+		} else if token.Type == "subscript" {
+			// Postfix operator with the container, the key or the slice bounds
+			count := 2
+			if token.Value == "slice" {
+				count = 3
+			}
+			if len(stack) < count {
+				return nil, fmt.Errorf("not enough operands for '[]'")
+			}
+			args := stack[len(stack)-count:]
+			stack = stack[:len(stack)-count]
+			result, err := e.applySubscript(args, policy)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, result)
 		} else if token.Type == "operator" {
 			op := token.Value
 			if op == "not" {
@@ -274,23 +482,32 @@ func (e *Expression) evaluateRPN(rpn []ExpressionToken, data map[string]any, res
 				if len(stack) == 0 {
 					return nil, fmt.Errorf("not enough operands for 'not'")
 				}
-				operand := stack[len(stack)-1]
+				value, err := definedValue(stack[len(stack)-1].value)
+				if err != nil {
+					return nil, err
+				}
 				stack = stack[:len(stack)-1]
-				stack = append(stack, !toBool(operand))
+				stack = append(stack, operand{value: !toBool(value)})
 			} else {
 				// Binary operator
 				if len(stack) < 2 {
 					return nil, fmt.Errorf("not enough operands for '%s'", op)
 				}
-				right := stack[len(stack)-1]
-				left := stack[len(stack)-2]
+				right, err := definedValue(stack[len(stack)-1].value)
+				if err != nil {
+					return nil, err
+				}
+				left, err := definedValue(stack[len(stack)-2].value)
+				if err != nil {
+					return nil, err
+				}
 				stack = stack[:len(stack)-2]
 
 				result, err := e.applyOperator(op, left, right)
 				if err != nil {
 					return nil, err
 				}
-				stack = append(stack, result)
+				stack = append(stack, operand{value: result})
 			}
 		}
 	}
@@ -299,7 +516,82 @@ func (e *Expression) evaluateRPN(rpn []ExpressionToken, data map[string]any, res
 		return nil, fmt.Errorf("malformed expression")
 	}
 
-	return stack[0], nil
+	return stack[0].value, nil
+}
+
+// applyCall calls a function value with arguments
+func (e *Expression) applyCall(fn operand, args []any) (any, error) {
+	value, err := definedValue(fn.value)
+	if err != nil {
+		return nil, err
+	}
+	if reflect.ValueOf(value).Kind() != reflect.Func {
+		return nil, fmt.Errorf("`%s` is not a function", fn.name)
+	}
+	result, err := callFunction(value, args)
+	if err != nil {
+		return nil, fmt.Errorf("`%s`: %v", fn.name, err)
+	}
+	return result, nil
+}
+
+// applySubscript applies an index or a slice to a container, resulting in an
+// undefined value when the key or index does not exist
+func (e *Expression) applySubscript(args []operand, policy UndefinedPolicy) (operand, error) {
+	container := args[0]
+	var keys []any
+	for _, arg := range args[1:] {
+		key, err := definedValue(arg.value)
+		if err != nil {
+			return operand{}, err
+		}
+		keys = append(keys, key)
+	}
+
+	// Describe the subscript in the way it was written
+	var parts []string
+	for i, key := range keys {
+		if args[i+1].name != "" {
+			parts = append(parts, args[i+1].name)
+		} else if s, ok := key.(string); ok {
+			parts = append(parts, strconv.Quote(s))
+		} else {
+			parts = append(parts, toString(key))
+		}
+	}
+	name := container.name + "[" + strings.Join(parts, ":") + "]"
+	if key, ok := keys[0].(string); ok && len(keys) == 1 && args[1].name == "" && identifierRegexp.MatchString(key) {
+		name = container.name + "." + key
+	}
+
+	if u, ok := container.value.(Undefined); ok {
+		// Accessing a key of an undefined value
+		if u.policy == UndefinedLenient || u.policy == UndefinedDebug {
+			return operand{}, u.err()
+		}
+		return operand{value: Undefined{Name: name, policy: u.policy}, name: name}, nil
+	}
+
+	if len(keys) == 2 {
+		val, err := sliceValue(container.value, keys[0], keys[1])
+		return operand{value: val, name: name}, err
+	}
+	val, exists, err := lookupIndex(container.value, keys[0])
+	if err != nil {
+		return operand{}, err
+	}
+	if !exists {
+		return operand{value: Undefined{Name: name, policy: policy}, name: name}, nil
+	}
+	return operand{value: val, name: name}, nil
+}
+
+// definedValue replaces an undefined operand by the value its policy allows
+func definedValue(value any) (any, error) {
+	if u, ok := value.(Undefined); ok {
+		return u.value()
+	}
+	return value, nil
 }
 
 // applyOperator applies a binary operator to two operands
@@ -6,6 +6,8 @@ import (
 	"math"
 	"net/url"
 	"reflect"
+	"slices"
+	"sort"
 	"strings"
 )
 
@@ -16,6 +18,7 @@ func getBuiltinFilters() map[string]any {
 		"attr":           filterAttr,
 		"capitalize":     filterCapitalize,
 		"default":        filterDefault,
+		"dictsort":       filterDictSort,
 		"filesizeformat": filterFileSizeFormat,
 		"first":          filterFirst,
 		"sprintf":        filterSprintf,
@@ -55,31 +58,9 @@ func filterAbs(value any) any {
 }
 
 // filterAttr gets an attribute of an object by name
-func filterAttr(obj any, name any) any {
-	attrName := toString(name)
-
-	// Handle map
-	if m, ok := obj.(map[string]any); ok {
-		if val, exists := m[attrName]; exists {
-			return val
-		}
-		return nil
-	}
-
-	// Handle struct using reflection
-	v := reflect.ValueOf(obj)
-	if v.Kind() == reflect.Ptr {
-		v = v.Elem()
-	}
-
-	if v.Kind() == reflect.Struct {
-		field := v.FieldByName(attrName)
-		if field.IsValid() {
-			return field.Interface()
-		}
-	}
-
-	return nil
+func filterAttr(obj any, name any) (any, error) {
+	val, _, err := lookupField(obj, toString(name))
+	return val, err
 }
 
 // filterCapitalize capitalizes the first character of a string
@@ -111,14 +92,66 @@ func filterDefault(value any, args ...any) any {
 		return value
 	}
 
-	// Default mode: only check for nil
-	if value == nil {
+	// Default mode: only check for nil or undefined
+	if _, isUndefined := value.(Undefined); isUndefined || value == nil {
 		return defaultValue
 	}
 
 	return value
 }
 
+// filterDictSort sorts a map by key or by value (first argument "key" or
+// "value"), optionally in reverse order (second argument), and returns it as
+// an ordered map so that a for loop iterates over it in that order
+func filterDictSort(value any, args ...any) (any, error) {
+	by := "key"
+	reverse := false
+
+	if len(args) > 0 {
+		by = toString(args[0])
+	}
+	if len(args) > 1 {
+		reverse = toBool(args[1])
+	}
+	if by != "key" && by != "value" {
+		return nil, fmt.Errorf("can only sort by `key` or `value`, not `%s`", by)
+	}
+
+	var values map[string]any
+	switch m := value.(type) {
+	case map[string]any:
+		values = m
+	case *OrderedMap:
+		values = m.values
+	default:
+		v := reflect.ValueOf(value)
+		if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("can only sort a map with string keys, not %T", value)
+		}
+		values = make(map[string]any, v.Len())
+		for iter := v.MapRange(); iter.Next(); {
+			values[iter.Key().String()] = normalizeValue(iter.Value().Interface())
+		}
+	}
+
+	keys := sortedKeys(values)
+
+	if by == "value" {
+		sort.SliceStable(keys, func(i, j int) bool {
+			return compareKeys(values[keys[i]], values[keys[j]]) < 0
+		})
+	}
+	if reverse {
+		slices.Reverse(keys)
+	}
+
+	result := NewOrderedMap()
+	for _, k := range keys {
+		result.Set(k, values[k])
+	}
+	return result, nil
+}
+
 // filterFileSizeFormat formats a number as a human-readable file size
 func filterFileSizeFormat(value any, args ...any) string {
 	num, ok := toNumber(value)
@@ -212,7 +245,7 @@ func filterJoin(value any, args ...any) string {
 	for _, item := range slice {
 		if attribute != "" {
 			// Join by attribute
-			item = filterAttr(item, attribute)
+			item, _ = filterAttr(item, attribute)
 		}
 		parts = append(parts, toString(item))
 	}
@@ -288,6 +321,16 @@ func filterLength(value any) int {
 		return len(m)
 	}
 
+	// Handle ordered map
+	if m, ok := value.(*OrderedMap); ok {
+		return m.Len()
+	}
+
+	// Handle other maps using reflection
+	if v := reflect.ValueOf(value); v.Kind() == reflect.Map {
+		return v.Len()
+	}
+
 	return 0
 }
 
@@ -456,7 +499,7 @@ func filterSum(value any, args ...any) float64 {
 	sum := 0.0
 	for _, item := range slice {
 		if attribute != "" {
-			item = filterAttr(item, attribute)
+			item, _ = filterAttr(item, attribute)
 		}
 
 		if num, ok := toNumber(item); ok {
@@ -533,6 +576,15 @@ func filterURLEncode(value any) string {
 		return values.Encode()
 	}
 
+	// Handle ordered map, keeping the order of the keys
+	if m, ok := value.(*OrderedMap); ok {
+		pairs := make([]string, 0, m.Len())
+		for _, k := range m.keys {
+			pairs = append(pairs, url.QueryEscape(k)+"="+url.QueryEscape(toString(m.values[k])))
+		}
+		return strings.Join(pairs, "&")
+	}
+
 	// Handle string
 	return url.QueryEscape(toString(value))
 }
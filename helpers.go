@@ -2,6 +2,7 @@ package tqtemplate
 
 import (
 	"fmt"
+	"reflect"
 	"strconv"
 )
 
@@ -16,9 +17,12 @@ func toBool(value any) bool {
 		return v != 0
 	case string:
 		return v != ""
-	case nil:
+	case nil, Undefined:
 		return false
 	default:
+		if num, ok := numericKind(value); ok {
+			return num != 0
+		}
 		return true
 	}
 }
@@ -36,8 +40,24 @@ func toNumber(value any) (float64, bool) {
 		}
 		return 0, false
 	default:
-		return 0, false
+		return numericKind(value)
+	}
+}
+
+// numericKind converts a value of a named numeric type, such as an enum or a
+// time.Duration that is kept by normalizeValue for its String method, to
+// float64
+func numericKind(value any) (float64, bool) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
 	}
+	return 0, false
 }
 
 // toString converts a value to string
@@ -45,6 +65,8 @@ func toString(value any) string {
 	switch v := value.(type) {
 	case string:
 		return v
+	case RawValue:
+		return v.Value
 	case int:
 		return strconv.Itoa(v)
 	case float64:
@@ -56,7 +78,7 @@ func toString(value any) string {
 			return "1"
 		}
 		return ""
-	case nil:
+	case nil, Undefined:
 		return ""
 	default:
 		return fmt.Sprintf("%v", v)
@@ -88,111 +110,182 @@ func compare(left, right any) int {
 	return 0
 }
 
-// callFunction calls a function with the given arguments
+// copyMap returns a shallow copy of a map, never nil
+func copyMap(m map[string]any) map[string]any {
+	result := make(map[string]any, len(m))
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// checkFunction returns an error if the value can not be called by callFunction
+func checkFunction(fn any) error {
+	ft := reflect.TypeOf(fn)
+	if ft == nil || ft.Kind() != reflect.Func {
+		return fmt.Errorf("%T is not a function", fn)
+	}
+	if ft.NumIn() == 0 {
+		return fmt.Errorf("function must accept at least one argument")
+	}
+	switch ft.NumOut() {
+	case 1:
+		if ft.Out(0) == errorType {
+			return fmt.Errorf("function must return a value")
+		}
+	case 2:
+		if ft.Out(1) != errorType {
+			return fmt.Errorf("second return value must be an error")
+		}
+	default:
+		return fmt.Errorf("function must return a value and an optional error")
+	}
+	return nil
+}
+
+// callFunction calls a function with the given arguments, converting each
+// argument to the type of the parameter. A non-nil error returned as the last
+// result of the function is returned as error.
 func callFunction(fn any, args []any) (any, error) {
+	// Fast path for the most common signatures
 	switch f := fn.(type) {
-	// RawValue functions
-	case func(any) RawValue:
-		if len(args) > 0 {
+	case func(any) any:
+		if len(args) == 1 {
 			return f(args[0]), nil
 		}
-		return nil, fmt.Errorf("invalid arguments for function")
-	case func(string) RawValue:
-		if len(args) > 0 {
-			if str, ok := args[0].(string); ok {
-				return f(str), nil
-			}
-		}
-		return nil, fmt.Errorf("invalid arguments for function")
-
-	// String functions
 	case func(any) string:
-		if len(args) > 0 {
+		if len(args) == 1 {
 			return f(args[0]), nil
 		}
-		return nil, fmt.Errorf("invalid arguments for function")
-	case func(string) string:
-		if len(args) > 0 {
-			return f(toString(args[0])), nil
-		}
-		return nil, fmt.Errorf("invalid arguments for function")
-	case func(string, string) string:
-		if len(args) >= 2 {
-			return f(toString(args[0]), toString(args[1])), nil
-		}
-		return nil, fmt.Errorf("invalid arguments for function")
-	case func(any, ...any) string:
+	case func(any, ...any) any:
 		if len(args) > 0 {
 			return f(args[0], args[1:]...), nil
 		}
-		return nil, fmt.Errorf("invalid arguments for function")
+	}
 
-	// Int functions
-	case func(any) int:
-		if len(args) > 0 {
-			return f(args[0]), nil
-		}
-		return nil, fmt.Errorf("invalid arguments for function")
+	if err := checkFunction(fn); err != nil {
+		return nil, err
+	}
+	fv := reflect.ValueOf(fn)
+	ft := fv.Type()
 
-	// Float64 functions
-	case func(any) float64:
-		if len(args) > 0 {
-			return f(args[0]), nil
+	// Check the number of arguments
+	numIn := ft.NumIn()
+	if ft.IsVariadic() {
+		if len(args) < numIn-1 {
+			return nil, fmt.Errorf("expected at least %d arguments, got %d", numIn-1, len(args))
 		}
-		return nil, fmt.Errorf("invalid arguments for function")
-	case func(any, ...any) float64:
-		if len(args) > 0 {
-			return f(args[0], args[1:]...), nil
-		}
-		return nil, fmt.Errorf("invalid arguments for function")
+	} else if len(args) != numIn {
+		return nil, fmt.Errorf("expected %d arguments, got %d", numIn, len(args))
+	}
 
-	// Any functions (generic)
-	case func(any) any:
-		if len(args) > 0 {
-			return f(args[0]), nil
+	// Convert the arguments to the parameter types
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		pt := ft.In(min(i, numIn-1))
+		if ft.IsVariadic() && i >= numIn-1 {
+			pt = pt.Elem()
 		}
-		return nil, fmt.Errorf("invalid arguments for function")
-	case func(any, any) any:
-		if len(args) >= 2 {
-			return f(args[0], args[1]), nil
+		v, err := convertValue(arg, pt)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %v", i+1, err)
 		}
-		return nil, fmt.Errorf("invalid arguments for function")
-	case func(any, ...any) any:
-		if len(args) > 0 {
-			return f(args[0], args[1:]...), nil
-		}
-		return nil, fmt.Errorf("invalid arguments for function")
+		in[i] = v
+	}
 
-	// Boolean functions
-	case func(any) bool:
-		if len(args) > 0 {
-			return f(args[0]), nil
-		}
-		return nil, fmt.Errorf("invalid arguments for function")
-	case func(any, ...any) bool:
-		if len(args) > 0 {
-			return f(args[0], args[1:]...), nil
+	out := fv.Call(in)
+	if len(out) == 2 && !out[1].IsNil() {
+		return nil, out[1].Interface().(error)
+	}
+	return normalizeValue(out[0].Interface()), nil
+}
+
+// convertValue converts a template value to a Go value of the given type
+func convertValue(value any, t reflect.Type) (reflect.Value, error) {
+	if value != nil {
+		if v := reflect.ValueOf(value); v.Type().AssignableTo(t) {
+			return v, nil
 		}
-		return nil, fmt.Errorf("invalid arguments for function")
-	case func(any, any) bool:
-		if len(args) >= 2 {
-			return f(args[0], args[1]), nil
+	}
+	switch value.(type) {
+	case nil, Undefined:
+		return reflect.Zero(t), nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return reflect.ValueOf(toString(value)).Convert(t), nil
+	case reflect.Bool:
+		return reflect.ValueOf(toBool(value)).Convert(t), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		if num, ok := toNumber(value); ok {
+			return reflect.ValueOf(num).Convert(t), nil
 		}
-		return nil, fmt.Errorf("invalid arguments for function")
-	case func(any, any, any) bool:
-		if len(args) >= 3 {
-			return f(args[0], args[1], args[2]), nil
+	case reflect.Slice:
+		v := reflect.ValueOf(value)
+		if v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+			result := reflect.MakeSlice(t, v.Len(), v.Len())
+			for i := 0; i < v.Len(); i++ {
+				elem, err := convertValue(v.Index(i).Interface(), t.Elem())
+				if err != nil {
+					return reflect.Value{}, err
+				}
+				result.Index(i).Set(elem)
+			}
+			return result, nil
 		}
-		return nil, fmt.Errorf("invalid arguments for function")
-	case func(int, int) bool:
-		if len(args) >= 2 {
-			left, _ := toNumber(args[0])
-			right, _ := toNumber(args[1])
-			return f(int(left), int(right)), nil
+	case reflect.Map:
+		v := reflect.ValueOf(value)
+		if v.Kind() == reflect.Map {
+			result := reflect.MakeMapWithSize(t, v.Len())
+			iter := v.MapRange()
+			for iter.Next() {
+				key, err := convertValue(iter.Key().Interface(), t.Key())
+				if err != nil {
+					return reflect.Value{}, err
+				}
+				elem, err := convertValue(iter.Value().Interface(), t.Elem())
+				if err != nil {
+					return reflect.Value{}, err
+				}
+				result.SetMapIndex(key, elem)
+			}
+			return result, nil
 		}
-		return nil, fmt.Errorf("invalid arguments for function")
+	}
 
-	default:
-		return nil, fmt.Errorf("unsupported function type")
+	// Named types with the same underlying type
+	if v := reflect.ValueOf(value); v.Type().ConvertibleTo(t) && v.Kind() == t.Kind() {
+		return v.Convert(t), nil
+	}
+	return reflect.Value{}, fmt.Errorf("cannot convert %T to %s", value, t)
+}
+
+// normalizeValue converts numbers returned by functions to int or float64,
+// the numeric types used by the template engine, and nil pointers to nil.
+// Values that implement fmt.Stringer are kept, so that they are rendered
+// using their String method, while toNumber and toBool still treat those of
+// a numeric kind as numbers.
+func normalizeValue(value any) any {
+	if _, ok := value.(fmt.Stringer); ok {
+		return value
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return int(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
 	}
+	return value
 }
@@ -0,0 +1,141 @@
+package tqtemplate
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// collectItems returns the keys and items a for loop iterates over. It
+// supports slices, arrays, maps (in sorted key order), ordered maps, strings
+// (by rune) and integers (from 0 up to the number). Channels and iterators
+// are not collected, see iterateLazy. Keys and items with a numeric kind are
+// normalized to int or float64.
+func collectItems(value any) ([]any, []any, error) {
+	var keys, items []any
+
+	// Fast paths for the types produced by decoding JSON and by the engine
+	switch v := value.(type) {
+	case []any:
+		for i := range v {
+			keys = append(keys, i)
+		}
+		return keys, v, nil
+	case map[string]any:
+		for _, k := range sortedKeys(v) {
+			keys = append(keys, k)
+			items = append(items, v[k])
+		}
+		return keys, items, nil
+	case *OrderedMap:
+		for _, k := range v.keys {
+			keys = append(keys, k)
+			items = append(items, v.values[k])
+		}
+		return keys, items, nil
+	case string:
+		i := 0
+		for _, r := range v {
+			keys = append(keys, i)
+			items = append(items, string(r))
+			i++
+		}
+		return keys, items, nil
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			keys = append(keys, i)
+			items = append(items, normalizeValue(v.Index(i).Interface()))
+		}
+	case reflect.Map:
+		mapKeys := make([]any, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			mapKeys = append(mapKeys, k.Interface())
+		}
+		sort.Slice(mapKeys, func(i, j int) bool {
+			return compareKeys(normalizeValue(mapKeys[i]), normalizeValue(mapKeys[j])) < 0
+		})
+		for _, k := range mapKeys {
+			keys = append(keys, normalizeValue(k))
+			items = append(items, normalizeValue(v.MapIndex(reflect.ValueOf(k)).Interface()))
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		keys, items = countItems(int(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		keys, items = countItems(int(v.Uint()))
+	default:
+		return nil, nil, fmt.Errorf("expression must evaluate to an array")
+	}
+
+	return keys, items, nil
+}
+
+// isLazy returns whether a value is a channel or an iter.Seq or iter.Seq2
+// function, whose items are produced while a for loop iterates over them
+func isLazy(value any) bool {
+	v := reflect.ValueOf(value)
+	return v.Kind() == reflect.Chan || (v.Kind() == reflect.Func && isIterator(v.Type()))
+}
+
+// iterateLazy calls yield with the key and item of each value received from a
+// channel (until it is closed) or yielded by an iter.Seq or iter.Seq2, like a
+// range loop in Go: it stops as soon as yield returns false, so the source
+// may be infinite. Keys and items with a numeric kind are normalized to int
+// or float64.
+func iterateLazy(value any, yield func(key, item any) bool) error {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Chan:
+		if v.Type().ChanDir()&reflect.RecvDir == 0 {
+			return fmt.Errorf("cannot iterate over send-only channel")
+		}
+		for i := 0; ; i++ {
+			item, ok := v.Recv()
+			if !ok || !yield(i, normalizeValue(item.Interface())) {
+				return nil
+			}
+		}
+	case reflect.Func:
+		if !isIterator(v.Type()) {
+			return fmt.Errorf("expression must evaluate to an array")
+		}
+		i := 0
+		next := reflect.MakeFunc(v.Type().In(0), func(args []reflect.Value) []reflect.Value {
+			var more bool
+			if len(args) == 2 {
+				more = yield(normalizeValue(args[0].Interface()), normalizeValue(args[1].Interface()))
+			} else {
+				more = yield(i, normalizeValue(args[0].Interface()))
+			}
+			i++
+			return []reflect.Value{reflect.ValueOf(more)}
+		})
+		v.Call([]reflect.Value{next})
+		return nil
+	}
+	return fmt.Errorf("expression must evaluate to an array")
+}
+
+// countItems returns the numbers from 0 up to n as both keys and items
+func countItems(n int) ([]any, []any) {
+	var items []any
+	for i := 0; i < n; i++ {
+		items = append(items, i)
+	}
+	return items, items
+}
+
+// isIterator returns whether a function type is an iter.Seq or iter.Seq2,
+// a function that takes a yield function with one or two arguments
+func isIterator(t reflect.Type) bool {
+	if t.Kind() != reflect.Func || t.NumIn() != 1 || t.NumOut() != 0 {
+		return false
+	}
+	yield := t.In(0)
+	return yield.Kind() == reflect.Func &&
+		(yield.NumIn() == 1 || yield.NumIn() == 2) &&
+		yield.NumOut() == 1 && yield.Out(0).Kind() == reflect.Bool
+}
@@ -0,0 +1,236 @@
+package tqtemplate
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// structFields caches the field indexes of struct types by field name
+var structFields sync.Map // map[reflect.Type]map[string][]int
+
+// lookupField returns the value of a named key, field or method of a value.
+// It supports maps with string keys, structs (including embedded fields and
+// fields renamed with a "tq" or "json" struct tag), pointers and methods
+// without arguments that return a value and optionally an error.
+func lookupField(value any, name string) (any, bool, error) {
+	switch m := value.(type) {
+	case map[string]any:
+		val, exists := m[name]
+		return val, exists, nil
+	case *OrderedMap:
+		val, exists := m.Get(name)
+		return val, exists, nil
+	case nil, Undefined:
+		return nil, false, nil
+	}
+
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, false, nil
+		}
+		// Methods may be declared on the pointer, so look for them first
+		if val, exists, err := callMethod(v, name); exists || err != nil {
+			return val, exists, err
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array, reflect.String:
+		// A numeric part is an index, as in "items.0"
+		if index, err := strconv.Atoi(name); err == nil {
+			val, exists := indexSequence(v, index)
+			return val, exists, nil
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() == reflect.String {
+			val := v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key()))
+			if val.IsValid() {
+				return normalizeValue(val.Interface()), true, nil
+			}
+		}
+	case reflect.Struct:
+		if index, ok := fieldIndexes(v.Type())[name]; ok {
+			field, err := v.FieldByIndexErr(index)
+			if err != nil {
+				// A nil embedded pointer
+				return nil, false, nil
+			}
+			return normalizeValue(field.Interface()), true, nil
+		}
+	}
+	return callMethod(v, name)
+}
+
+// lookupIndex returns the value of a key or index of a value. A string key
+// is looked up like a part of a path, a number indexes a slice, array or
+// string, where a negative index counts from the end.
+func lookupIndex(value any, key any) (any, bool, error) {
+	if name, ok := key.(string); ok {
+		return lookupField(value, name)
+	}
+	if value == nil {
+		return nil, false, nil
+	}
+
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, false, nil
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array, reflect.String:
+		num, ok := toNumber(key)
+		if !ok || num != float64(int(num)) {
+			return nil, false, fmt.Errorf("index must be an integer, not %s", toString(key))
+		}
+		val, exists := indexSequence(v, int(num))
+		return val, exists, nil
+	case reflect.Map:
+		k, err := convertValue(key, v.Type().Key())
+		if err != nil {
+			return nil, false, nil
+		}
+		if val := v.MapIndex(k); val.IsValid() {
+			return normalizeValue(val.Interface()), true, nil
+		}
+		return nil, false, nil
+	}
+	return lookupField(value, toString(key))
+}
+
+// indexSequence returns the item at an index of a slice, array or string (by
+// rune), where a negative index counts from the end
+func indexSequence(v reflect.Value, index int) (any, bool) {
+	if v.Kind() == reflect.String {
+		runes := []rune(v.String())
+		if index < 0 {
+			index += len(runes)
+		}
+		if index < 0 || index >= len(runes) {
+			return nil, false
+		}
+		return string(runes[index]), true
+	}
+	if index < 0 {
+		index += v.Len()
+	}
+	if index < 0 || index >= v.Len() {
+		return nil, false
+	}
+	return normalizeValue(v.Index(index).Interface()), true
+}
+
+// sliceValue returns the items of a slice, array or string (by rune) from
+// start up to end, where nil means the start or the end of the value and a
+// negative bound counts from the end
+func sliceValue(value any, start, end any) (any, error) {
+	bounds := func(length int) (int, int, error) {
+		result := []int{0, length}
+		for i, bound := range []any{start, end} {
+			if bound == nil {
+				continue
+			}
+			num, ok := toNumber(bound)
+			if !ok || num != float64(int(num)) {
+				return 0, 0, fmt.Errorf("slice bound must be an integer, not %s", toString(bound))
+			}
+			index := int(num)
+			if index < 0 {
+				index += length
+			}
+			result[i] = min(max(index, 0), length)
+		}
+		return result[0], max(result[0], result[1]), nil
+	}
+
+	if s, ok := value.(string); ok {
+		runes := []rune(s)
+		from, to, err := bounds(len(runes))
+		if err != nil {
+			return nil, err
+		}
+		return string(runes[from:to]), nil
+	}
+
+	items := toSlice(value)
+	if items == nil {
+		if v := reflect.ValueOf(value); v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+			return nil, fmt.Errorf("cannot slice %T", value)
+		}
+	}
+	from, to, err := bounds(len(items))
+	if err != nil {
+		return nil, err
+	}
+	return items[from:to], nil
+}
+
+// callMethod calls a method without arguments by name, returning whether
+// the method exists
+func callMethod(v reflect.Value, name string) (any, bool, error) {
+	method := v.MethodByName(name)
+	if !method.IsValid() {
+		return nil, false, nil
+	}
+	mt := method.Type()
+	if mt.NumIn() != 0 || mt.NumOut() == 0 || mt.NumOut() > 2 || (mt.NumOut() == 2 && mt.Out(1) != errorType) {
+		return nil, false, nil
+	}
+	out := method.Call(nil)
+	if len(out) == 2 && !out[1].IsNil() {
+		return nil, true, out[1].Interface().(error)
+	}
+	return normalizeValue(out[0].Interface()), true, nil
+}
+
+// fieldIndexes returns the indexes of the exported fields of a struct type,
+// including promoted fields of embedded structs, by name. A field is named
+// by its "tq" or "json" struct tag, and by its Go name when no other field
+// uses that name.
+func fieldIndexes(t reflect.Type) map[string][]int {
+	if cached, ok := structFields.Load(t); ok {
+		return cached.(map[string][]int)
+	}
+
+	indexes := make(map[string][]int)
+	// add adds a field by name, a shallower field wins over a deeper one
+	add := func(name string, index []int) {
+		if existing, ok := indexes[name]; !ok || len(index) < len(existing) {
+			indexes[name] = index
+		}
+	}
+	var fields []reflect.StructField
+	for _, field := range reflect.VisibleFields(t) {
+		if !field.IsExported() {
+			continue
+		}
+		tag, ok := field.Tag.Lookup("tq")
+		if !ok {
+			tag = field.Tag.Get("json")
+		}
+		tagName, _, _ := strings.Cut(tag, ",")
+		if tagName == "-" {
+			continue
+		}
+		if tagName != "" {
+			add(tagName, field.Index)
+		}
+		fields = append(fields, field)
+	}
+	for _, field := range fields {
+		if _, exists := indexes[field.Name]; !exists {
+			indexes[field.Name] = field.Index
+		}
+	}
+
+	structFields.Store(t, indexes)
+	return indexes
+}
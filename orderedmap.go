@@ -0,0 +1,138 @@
+package tqtemplate
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OrderedMap is a map that keeps its keys in insertion order. For loops
+// iterate over it in that order, where a map[string]any is iterated over in
+// sorted key order. The zero value is an empty map ready to use.
+type OrderedMap struct {
+	keys   []string
+	values map[string]any
+}
+
+// NewOrderedMap creates an empty ordered map
+func NewOrderedMap() *OrderedMap {
+	return &OrderedMap{values: make(map[string]any)}
+}
+
+// Set sets the value of a key, a new key is added at the end
+func (m *OrderedMap) Set(key string, value any) {
+	if m.values == nil {
+		m.values = make(map[string]any)
+	}
+	if _, exists := m.values[key]; !exists {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = value
+}
+
+// Get returns the value of a key and whether the key exists
+func (m *OrderedMap) Get(key string) (any, bool) {
+	value, exists := m.values[key]
+	return value, exists
+}
+
+// Delete removes a key
+func (m *OrderedMap) Delete(key string) {
+	if _, exists := m.values[key]; !exists {
+		return
+	}
+	delete(m.values, key)
+	for i, k := range m.keys {
+		if k == key {
+			m.keys = append(m.keys[:i], m.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// Keys returns the keys in insertion order
+func (m *OrderedMap) Keys() []string {
+	return append([]string{}, m.keys...)
+}
+
+// Len returns the number of keys
+func (m *OrderedMap) Len() int {
+	return len(m.keys)
+}
+
+// MarshalJSON encodes the map as a JSON object with the keys in order
+func (m *OrderedMap) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range m.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(m.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// sortedKeys returns the keys of a map in sorted order (see compareKeys)
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return compareKeys(keys[i], keys[j]) < 0
+	})
+	return keys
+}
+
+// decimalRegexp matches the integer and decimal numbers that are sorted by
+// their numeric value when they are used as a key
+var decimalRegexp = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// numericKey returns the numeric value of a key that is a number, or a
+// string with an integer or decimal number
+func numericKey(key any) (float64, bool) {
+	if s, ok := key.(string); ok {
+		if !decimalRegexp.MatchString(s) {
+			return 0, false
+		}
+		num, err := strconv.ParseFloat(s, 64)
+		return num, err == nil
+	}
+	num, ok := toNumber(key)
+	return num, ok && !math.IsNaN(num)
+}
+
+// compareKeys compares keys in a total order, so that sorting is stable
+// between renders: numbers come first and are compared by their value, all
+// other keys follow and are compared as strings. Ties are broken on the
+// string form of the keys, so "2" and "2.0" have a fixed order.
+func compareKeys(a, b any) int {
+	aNum, aIsNum := numericKey(a)
+	bNum, bIsNum := numericKey(b)
+	switch {
+	case aIsNum && !bIsNum:
+		return -1
+	case !aIsNum && bIsNum:
+		return 1
+	case aIsNum && bIsNum && aNum != bNum:
+		return cmp.Compare(aNum, bNum)
+	}
+	return strings.Compare(toString(a), toString(b))
+}
@@ -0,0 +1,114 @@
+package tqtemplate
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// AddFilter registers a custom filter, overriding any filter with the same
+// name. The function is called with the filtered value and the filter
+// arguments, converted to the parameter types. It may return an error as
+// second return value. AddFilter returns an error for invalid functions.
+// Compiled templates keep the filters that were registered when compiling.
+func (t *Template) AddFilter(name string, fn any) error {
+	if err := checkFunction(fn); err != nil {
+		return fmt.Errorf("filter `%s`: %v", name, err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.filters == nil {
+		t.filters = make(map[string]any)
+	}
+	t.filters[name] = fn
+	return nil
+}
+
+// RemoveFilter removes a custom filter, restoring the builtin filter if any
+func (t *Template) RemoveFilter(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.filters, name)
+}
+
+// Filter returns the custom or builtin filter with the given name
+func (t *Template) Filter(name string) (any, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if fn, exists := t.filters[name]; exists {
+		return fn, true
+	}
+	fn, exists := getBuiltinFilters()[name]
+	return fn, exists
+}
+
+// AddTest registers a custom test, overriding any test with the same name.
+// Like a filter, but it must return a bool (and optionally an error).
+// Compiled templates keep the tests that were registered when compiling.
+func (t *Template) AddTest(name string, fn any) error {
+	if err := checkTest(fn); err != nil {
+		return fmt.Errorf("test `%s`: %v", name, err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tests == nil {
+		t.tests = make(map[string]any)
+	}
+	t.tests[name] = fn
+	return nil
+}
+
+// RemoveTest removes a custom test, restoring the builtin test if any
+func (t *Template) RemoveTest(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.tests, name)
+}
+
+// Test returns the custom or builtin test with the given name
+func (t *Template) Test(name string) (any, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if fn, exists := t.tests[name]; exists {
+		return fn, true
+	}
+	fn, exists := getBuiltinTests()[name]
+	return fn, exists
+}
+
+// AddGlobal registers a variable that is available in every render, unless
+// the data passed to the render has a variable with the same name. Compiled
+// templates keep the globals that were registered when compiling.
+func (t *Template) AddGlobal(name string, value any) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.globals == nil {
+		t.globals = make(map[string]any)
+	}
+	t.globals[name] = value
+}
+
+// RemoveGlobal removes a global variable
+func (t *Template) RemoveGlobal(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.globals, name)
+}
+
+// Global returns the global variable with the given name
+func (t *Template) Global(name string) (any, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	value, exists := t.globals[name]
+	return value, exists
+}
+
+// checkTest returns an error if the value can not be used as a test
+func checkTest(fn any) error {
+	if err := checkFunction(fn); err != nil {
+		return err
+	}
+	if reflect.TypeOf(fn).Out(0).Kind() != reflect.Bool {
+		return fmt.Errorf("test must return a bool")
+	}
+	return nil
+}
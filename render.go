@@ -1,439 +1,619 @@
 package tqtemplate
 
 import (
+	"errors"
 	"fmt"
-	"regexp"
-	"strconv"
+	"io"
 	"strings"
 )
 
-// renderChildren renders all child nodes of a given node
-func (t *Template) renderChildren(node *TreeNode, data map[string]any, filters map[string]any) (string, error) {
-	result := ""
-	ifNodes := []*TreeNode{}
+// renderContext holds the state of a single render
+type renderContext struct {
+	filters map[string]any
+	depth   int
+	loops   []loopFrame // the enclosing loops, innermost last
+}
+
+// loopFrame is a loop that is being rendered
+type loopFrame struct {
+	node *TreeNode      // the 'for' node
+	data map[string]any // the data the loop was rendered with
+	loop map[string]any // the loop variable of the current iteration
+}
+
+// errBreak and errContinue stop rendering the body of a loop, they are
+// returned by break and continue nodes and handled by renderForNode
+var (
+	errBreak    = errors.New("`break` outside of loop")
+	errContinue = errors.New("`continue` outside of loop")
+)
+
+// renderChildren renders all child nodes of a given node to the writer
+func (t *Template) renderChildren(w io.Writer, node *TreeNode, data map[string]any, ctx *renderContext) error {
+	chain := ifChain{}
 
 	for _, child := range node.Children {
+		var err error
 		switch child.Type {
 		case "block":
-			// Render block content directly when not in extends context
-			output, err := t.renderChildren(child, data, filters)
-			if err != nil {
-				return "", err
-			}
-			result += output
-			ifNodes = []*TreeNode{}
+			// Render block content directly when not in extends context,
+			// variables set in the block are local to the block
+			err = t.renderChildren(w, child, copyMap(data), ctx)
+			chain = ifChain{}
 		case "if":
-			output, err := t.renderIfNode(child, data, filters)
-			if err != nil {
-				return "", err
-			}
-			result += output
-			ifNodes = []*TreeNode{child}
+			err = t.renderIfNode(w, child, &chain, data, ctx)
 		case "elseif":
-			output, err := t.renderElseIfNode(child, ifNodes, data, filters)
-			if err != nil {
-				return "", err
-			}
-			result += output
-			ifNodes = append(ifNodes, child)
+			err = t.renderElseIfNode(w, child, &chain, data, ctx)
 		case "else":
-			output, err := t.renderElseNode(child, ifNodes, data, filters)
-			if err != nil {
-				return "", err
-			}
-			result += output
-			ifNodes = []*TreeNode{}
+			err = t.renderElseNode(w, child, &chain, data, ctx)
+			chain = ifChain{}
 		case "for":
-			output, err := t.renderForNode(child, data, filters)
-			if err != nil {
-				return "", err
-			}
-			result += output
-			ifNodes = []*TreeNode{}
+			err = t.renderForNode(w, child, data, ctx)
+			chain = ifChain{}
 		case "var":
-			output, err := t.renderVarNode(child, data, filters)
-			if err != nil {
-				return "", err
-			}
-			result += output
-			ifNodes = []*TreeNode{}
+			err = t.renderVarNode(w, child, data, ctx)
+			chain = ifChain{}
 		case "include":
-			output, err := t.renderIncludeNode(child, data, filters)
-			if err != nil {
-				return "", err
-			}
-			result += output
-			ifNodes = []*TreeNode{}
+			err = t.renderIncludeNode(w, child, data, ctx)
+			chain = ifChain{}
+		case "set":
+			err = t.renderSetNode(w, child, data, ctx)
+			chain = ifChain{}
+		case "with":
+			err = t.renderWithNode(w, child, data, ctx)
+			chain = ifChain{}
 		case "lit":
-			result += child.Expression
-			ifNodes = []*TreeNode{}
+			_, err = io.WriteString(w, child.Expression)
+			chain = ifChain{}
+		case "forelse":
+			// Rendered by renderForNode when the loop has no items
+		case "break", "continue":
+			err = t.renderLoopControlNode(w, child, data, ctx)
+			chain = ifChain{}
+		}
+		if err != nil {
+			return err
 		}
 	}
 
-	return result, nil
+	return nil
+}
+
+// ifChain tracks the state of an if/elseif/else chain during a single render
+type ifChain struct {
+	started bool
+	matched bool
 }
 
 // renderIfNode renders an 'if' conditional node
-func (t *Template) renderIfNode(node *TreeNode, data map[string]any, filters map[string]any) (string, error) {
-	expressionStr := node.Expression
+func (t *Template) renderIfNode(w io.Writer, node *TreeNode, chain *ifChain, data map[string]any, ctx *renderContext) error {
+	*chain = ifChain{started: true}
 
-	// Preprocess "is" tests
-	exprPart, testFilter := processIsTests(expressionStr)
+	value, err := t.evaluateNode(node, data, ctx)
+	if err != nil {
+		return t.renderError(w, node, err)
+	}
 
-	parts := t.explodeRespectingQuotes("|", exprPart, -1)
-	actualExpr := parts[0]
-	filterParts := parts[1:]
+	chain.matched = toBool(value)
+	if chain.matched {
+		return t.renderChildren(w, node, data, ctx)
+	}
+	return nil
+}
 
-	// Add test filter if present
-	if testFilter != "" {
-		filterParts = append(filterParts, testFilter)
+// renderElseIfNode renders an 'elseif' conditional node
+func (t *Template) renderElseIfNode(w io.Writer, node *TreeNode, chain *ifChain, data map[string]any, ctx *renderContext) error {
+	if !chain.started {
+		return t.renderError(w, node, fmt.Errorf("could not find matching `if`"))
+	}
+	if chain.matched {
+		return nil
 	}
 
-	expr := NewExpression(actualExpr)
-	value, err := expr.Evaluate(data, t.resolvePath)
+	value, err := t.evaluateNode(node, data, ctx)
+	if err != nil {
+		return t.renderError(w, node, err)
+	}
 
-	// Special handling for "defined" and "undefined" tests
-	// If we have an error and the test is for defined/undefined, handle it specially
-	if err != nil && (strings.Contains(testFilter, "__istest__(\"defined\")") ||
-		strings.Contains(testFilter, "__istest__(\"undefined\")") ||
-		strings.Contains(testFilter, "__isnot__(\"defined\")") ||
-		strings.Contains(testFilter, "__isnot__(\"undefined\")")) {
-		// For defined/undefined tests, use sentinel value to indicate undefined
-		value = undefinedValue
-		err = nil
+	chain.matched = toBool(value)
+	if chain.matched {
+		return t.renderChildren(w, node, data, ctx)
 	}
+	return nil
+}
+
+// renderElseNode renders an 'else' node
+func (t *Template) renderElseNode(w io.Writer, node *TreeNode, chain *ifChain, data map[string]any, ctx *renderContext) error {
+	if !chain.started {
+		return t.renderError(w, node, fmt.Errorf("could not find matching `if`"))
+	}
+	if chain.matched {
+		return nil
+	}
+	return t.renderChildren(w, node, data, ctx)
+}
 
+// renderForNode renders a 'for' loop node
+func (t *Template) renderForNode(w io.Writer, node *TreeNode, data map[string]any, ctx *renderContext) error {
+	value, err := node.expr.evaluate(data, t)
 	if err != nil {
-		return t.escapeValue("{% if " + expressionStr + "!!" + err.Error() + " %}"), nil
+		return t.renderError(w, node, err)
 	}
 
-	value, err = t.applyfilters(value, filterParts, filters, data)
+	value, err = t.applyfilters(value, node.chain, ctx.filters, data)
 	if err != nil {
-		return t.escapeValue("{% if " + expressionStr + "!!" + err.Error() + " %}"), nil
+		return t.renderError(w, node, err)
 	}
+	return t.renderLoop(w, node, value, data, ctx)
+}
 
-	result := ""
-	if toBool(value) {
-		output, err := t.renderChildren(node, data, filters)
-		if err != nil {
-			return "", err
+// renderLoop renders the body of a 'for' loop node for each item of a value
+func (t *Template) renderLoop(w io.Writer, node *TreeNode, value any, data map[string]any, ctx *renderContext) error {
+	// An undefined value is an empty loop, unless the policy forbids its use
+	if u, ok := value.(Undefined); ok {
+		if _, err := u.value(); err != nil {
+			return t.renderError(w, node, err)
 		}
-		result += output
+		return t.renderForElse(w, node, data, ctx)
 	}
-	node.Value = toBool(value)
-	return result, nil
-}
 
-// renderElseIfNode renders an 'elseif' conditional node
-func (t *Template) renderElseIfNode(node *TreeNode, ifNodes []*TreeNode, data map[string]any, filters map[string]any) (string, error) {
-	if len(ifNodes) < 1 || ifNodes[0].Type != "if" {
-		return t.escapeValue("{% elseif !!could not find matching `if` %}"), nil
+	// The loop variable of the enclosing loop is the parent of this loop
+	var parent map[string]any
+	if len(ctx.loops) > 0 {
+		parent = ctx.loops[len(ctx.loops)-1].loop
 	}
+	depth := len(ctx.loops) + 1
 
-	result := ""
-	anyTrue := false
-	for _, ifNode := range ifNodes {
-		if val, ok := ifNode.Value.(bool); ok && val {
-			anyTrue = true
-			break
-		}
+	if isLazy(value) {
+		return t.renderLazyLoop(w, node, value, data, parent, ctx)
 	}
 
-	if !anyTrue {
-		expressionStr := node.Expression
+	keys, items, err := collectItems(value)
+	if err != nil {
+		return t.renderError(w, node, err)
+	}
 
-		// Preprocess "is" tests
-		exprPart, testFilter := processIsTests(expressionStr)
+	// Create the data of each iteration, skipping items not matching the condition
+	var iterations []map[string]any
+	var filtered []any
+	for i, item := range items {
+		newData, matched, err := t.newIteration(node, data, keys[i], item, ctx)
+		if err != nil {
+			return t.renderError(w, node, err)
+		}
+		if !matched {
+			continue
+		}
+		iterations = append(iterations, newData)
+		filtered = append(filtered, item)
+	}
 
-		parts := t.explodeRespectingQuotes("|", exprPart, -1)
-		actualExpr := parts[0]
-		filterParts := parts[1:]
+	if len(iterations) == 0 {
+		return t.renderForElse(w, node, data, ctx)
+	}
 
-		// Add test filter if present
-		if testFilter != "" {
-			filterParts = append(filterParts, testFilter)
+	for i, newData := range iterations {
+		loop := newLoopVariable(i, parent, depth)
+		addLookahead(loop, filtered, i)
+		err := t.renderIteration(w, node, data, newData, loop, ctx)
+		if err == errBreak {
+			break
 		}
-
-		expr := NewExpression(actualExpr)
-		value, err := expr.Evaluate(data, t.resolvePath)
-
-		// Special handling for "defined" and "undefined" tests
-		// If we have an error and the test is for defined/undefined, handle it specially
-		if err != nil && (strings.Contains(testFilter, "__istest__(\"defined\")") ||
-			strings.Contains(testFilter, "__istest__(\"undefined\")") ||
-			strings.Contains(testFilter, "__isnot__(\"defined\")") ||
-			strings.Contains(testFilter, "__isnot__(\"undefined\")")) {
-			// For defined/undefined tests, use sentinel value to indicate undefined
-			value = undefinedValue
-			err = nil
+		if err != nil && err != errContinue {
+			return err
 		}
+	}
 
+	return nil
+}
+
+// renderLazyLoop renders the body of a 'for' loop node for each item of a
+// channel or iterator as it is produced, and stops the source on a 'break'.
+// The items that follow are unknown, so the loop variable has no length,
+// revindex, revindex0, last or nextitem.
+func (t *Template) renderLazyLoop(w io.Writer, node *TreeNode, value any, data map[string]any, parent map[string]any, ctx *renderContext) error {
+	depth := len(ctx.loops) + 1
+	i := 0
+	var previous any
+	var renderErr error
+	err := iterateLazy(value, func(key, item any) bool {
+		newData, matched, err := t.newIteration(node, data, key, item, ctx)
 		if err != nil {
-			return t.escapeValue("{% elseif " + expressionStr + "!!" + err.Error() + " %}"), nil
+			renderErr = t.renderError(w, node, err)
+			return false
+		}
+		if !matched {
+			return true
+		}
+		loop := newLoopVariable(i, parent, depth)
+		if i > 0 {
+			loop["previtem"] = previous
+		}
+		previous = item
+		i++
+		err = t.renderIteration(w, node, data, newData, loop, ctx)
+		if err == errBreak {
+			return false
+		}
+		if err != nil && err != errContinue {
+			renderErr = err
+			return false
 		}
+		return true
+	})
+	if err != nil {
+		return t.renderError(w, node, err)
+	}
+	if renderErr != nil {
+		return renderErr
+	}
+	if i == 0 {
+		return t.renderForElse(w, node, data, ctx)
+	}
+	return nil
+}
 
-		value, err = t.applyfilters(value, filterParts, filters, data)
+// newIteration creates the data of an iteration of a 'for' loop node and
+// returns whether the item matches the condition of the loop
+func (t *Template) newIteration(node *TreeNode, data map[string]any, key, item any, ctx *renderContext) (map[string]any, bool, error) {
+	newData := make(map[string]any)
+	for k, v := range data {
+		newData[k] = v
+	}
+	if node.forKey != "" {
+		newData[node.forKey] = key
+	}
+	newData[node.forValue] = item
+
+	if node.forCond != nil {
+		matched, err := t.evaluateNode(node.forCond, newData, ctx)
 		if err != nil {
-			return t.escapeValue("{% elseif " + expressionStr + "!!" + err.Error() + " %}"), nil
+			return nil, false, err
 		}
-
-		if toBool(value) {
-			output, err := t.renderChildren(node, data, filters)
-			if err != nil {
-				return "", err
-			}
-			result += output
+		if !toBool(matched) {
+			return nil, false, nil
 		}
-		node.Value = toBool(value)
-	} else {
-		node.Value = false
 	}
+	return newData, true, nil
+}
 
-	return result, nil
+// renderIteration renders the body of a 'for' loop node for one iteration
+func (t *Template) renderIteration(w io.Writer, node *TreeNode, data, newData, loop map[string]any, ctx *renderContext) error {
+	newData["loop"] = loop
+	ctx.loops = append(ctx.loops, loopFrame{node: node, data: data, loop: loop})
+	err := t.renderChildren(w, node, newData, ctx)
+	ctx.loops = ctx.loops[:len(ctx.loops)-1]
+	return err
 }
 
-// renderElseNode renders an 'else' node
-func (t *Template) renderElseNode(node *TreeNode, ifNodes []*TreeNode, data map[string]any, filters map[string]any) (string, error) {
-	if len(ifNodes) < 1 || ifNodes[0].Type != "if" {
-		return t.escapeValue("{% else !!could not find matching `if` %}"), nil
+// renderLoopCall renders a "loop(items)" call, which renders the body of the
+// innermost loop, that must be recursive, for the given items
+func (t *Template) renderLoopCall(w io.Writer, node *TreeNode, data map[string]any, ctx *renderContext) error {
+	if len(ctx.loops) == 0 || !ctx.loops[len(ctx.loops)-1].node.recursive {
+		return t.renderError(w, node, fmt.Errorf("`loop()` can only be used in a recursive loop"))
+	}
+	if len(ctx.loops) >= t.maxIncludeDepth {
+		return t.renderError(w, node, fmt.Errorf("maximum loop depth of %d exceeded", t.maxIncludeDepth))
 	}
 
-	result := ""
-	anyTrue := false
-	for _, ifNode := range ifNodes {
-		if val, ok := ifNode.Value.(bool); ok && val {
-			anyTrue = true
-			break
-		}
+	value, err := node.expr.evaluate(data, t)
+	if err == nil {
+		value, err = t.applyfilters(value, node.chain, ctx.filters, data)
+	}
+	if err != nil {
+		return t.renderError(w, node, err)
 	}
 
-	if !anyTrue {
-		output, err := t.renderChildren(node, data, filters)
+	// Render with the data of the loop, not the data of the current iteration
+	frame := ctx.loops[len(ctx.loops)-1]
+	return t.renderLoop(w, frame.node, value, frame.data, ctx)
+}
+
+// renderLoopControlNode renders a 'break' or 'continue' node, which stops the
+// current iteration of the enclosing loop if it has no condition or the
+// condition is true
+func (t *Template) renderLoopControlNode(w io.Writer, node *TreeNode, data map[string]any, ctx *renderContext) error {
+	if node.expr != nil {
+		value, err := t.evaluateNode(node, data, ctx)
 		if err != nil {
-			return "", err
+			return t.renderError(w, node, err)
 		}
-		result += output
+		if !toBool(value) {
+			return nil
+		}
+	}
+	if node.Type == "break" {
+		return errBreak
 	}
+	return errContinue
+}
 
-	return result, nil
+// renderForElse renders the 'else' of a 'for' loop node, if it has one
+func (t *Template) renderForElse(w io.Writer, node *TreeNode, data map[string]any, ctx *renderContext) error {
+	if n := len(node.Children); n > 0 && node.Children[n-1].Type == "forelse" {
+		return t.renderChildren(w, node.Children[n-1], data, ctx)
+	}
+	return nil
 }
 
-// renderForNode renders a 'for' loop node
-func (t *Template) renderForNode(node *TreeNode, data map[string]any, filters map[string]any) (string, error) {
-	expressionStr := node.Expression
-
-	// Parse "for key, value in array" or "for value in array"
-	re := regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*(?:\s*,\s*[a-zA-Z_][a-zA-Z0-9_]*)?)\s+in\s+(.+)$`)
-	matches := re.FindStringSubmatch(expressionStr)
-	if matches == nil {
-		return t.escapeValue(`{% for ` + expressionStr + `!!invalid syntax, expected "item in array" or "key, value in array" %}`), nil
-	}
-
-	vars := matches[1]
-	arrayExpr := matches[2]
-
-	// Check if we have "key, value" or just "value"
-	var key, varName string
-	hasKey := strings.Contains(vars, ",")
-	if hasKey {
-		varParts := strings.Split(vars, ",")
-		key = strings.TrimSpace(varParts[0])
-		varName = strings.TrimSpace(varParts[1])
-	} else {
-		varName = strings.TrimSpace(vars)
+// newLoopVariable creates the "loop" variable for an iteration of a loop. The
+// previtem, nextitem and parent keys are undefined when they do not exist.
+func newLoopVariable(i int, parent map[string]any, depth int) map[string]any {
+	loop := map[string]any{
+		"index":  i + 1,
+		"index0": i,
+		"first":  i == 0,
+		"depth":  depth,
+		"depth0": depth - 1,
+		"cycle": func(values ...any) any {
+			if len(values) == 0 {
+				return nil
+			}
+			return values[i%len(values)]
+		},
 	}
+	if parent != nil {
+		loop["parent"] = parent
+	}
+	return loop
+}
 
-	// Parse filters from array expression
-	parts := t.explodeRespectingQuotes("|", arrayExpr, -1)
-	path := strings.TrimSpace(parts[0])
-	filterParts := parts[1:]
+// addLookahead adds the keys of the loop variable that depend on all items of
+// the loop, which are known unless the loop iterates over a lazy source
+func addLookahead(loop map[string]any, items []any, i int) {
+	length := len(items)
+	loop["revindex"] = length - i
+	loop["revindex0"] = length - i - 1
+	loop["last"] = i == length-1
+	loop["length"] = length
+	if i > 0 {
+		loop["previtem"] = items[i-1]
+	}
+	if i < length-1 {
+		loop["nextitem"] = items[i+1]
+	}
+}
 
-	value, err := t.resolvePath(path, data)
+// renderVarNode renders a variable interpolation node
+func (t *Template) renderVarNode(w io.Writer, node *TreeNode, data map[string]any, ctx *renderContext) error {
+	if node.recurse {
+		return t.renderLoopCall(w, node, data, ctx)
+	}
+	value, err := node.expr.evaluate(data, t)
 	if err != nil {
-		return t.escapeValue("{% for " + expressionStr + "!!" + err.Error() + " %}"), nil
+		return t.renderError(w, node, err)
 	}
 
-	value, err = t.applyfilters(value, filterParts, filters, data)
+	value, err = t.applyfilters(value, node.chain, ctx.filters, data)
 	if err != nil {
-		return t.escapeValue("{% for " + expressionStr + "!!" + err.Error() + " %}"), nil
+		return t.renderError(w, node, err)
 	}
 
-	// Convert to slice
-	var items []any
-	var keys []any
-
-	switch v := value.(type) {
-	case []any:
-		items = v
-		for i := range items {
-			keys = append(keys, i)
+	if u, ok := value.(Undefined); ok {
+		if t.undefinedPolicy == UndefinedDebug {
+			return t.writeEscaped(w, t.delimiters.VariableStart+" "+u.Name+" "+t.delimiters.VariableEnd)
 		}
-	case map[string]any:
-		for k, val := range v {
-			keys = append(keys, k)
-			items = append(items, val)
+		if value, err = u.value(); err != nil {
+			return t.renderError(w, node, err)
 		}
-	default:
-		return t.escapeValue("{% for " + expressionStr + "!!expression must evaluate to an array %}"), nil
 	}
 
-	result := ""
-	for i, item := range items {
-		newData := make(map[string]any)
-		for k, v := range data {
-			newData[k] = v
-		}
-		if hasKey {
-			newData[key] = keys[i]
-			newData[varName] = item
-		} else {
-			newData[varName] = item
-		}
-		output, err := t.renderChildren(node, newData, filters)
-		if err != nil {
-			return "", err
+	return t.writeEscaped(w, value)
+}
+
+// renderError handles an error evaluating a node according to the error mode
+func (t *Template) renderError(w io.Writer, node *TreeNode, err error) error {
+	switch t.errorMode {
+	case ErrorModeStrict:
+		return t.newRenderError(node, err)
+	case ErrorModeLenient:
+		if t.warningHandler != nil {
+			t.warningHandler(t.newRenderError(node, err))
 		}
-		result += output
+		return nil
 	}
 
-	return result, nil
+	// Inline the error as escaped text in the output
+	d := &t.delimiters
+	if node.Type == "var" {
+		return t.writeEscaped(w, d.VariableStart+node.Expression+"!!"+err.Error()+d.VariableEnd)
+	}
+	return t.writeEscaped(w, d.BlockStart+" "+node.Type+" "+node.Expression+"!!"+err.Error()+" "+d.BlockEnd)
 }
 
-// renderVarNode renders a variable interpolation node
-func (t *Template) renderVarNode(node *TreeNode, data map[string]any, filters map[string]any) (string, error) {
-	expressionStr := node.Expression
-
-	// Preprocess "is" tests
-	exprPart, testFilter := processIsTests(expressionStr)
-
-	parts := t.explodeRespectingQuotes("|", exprPart, -1)
-	actualExpr := parts[0]
-	filterParts := parts[1:]
-
-	// Add test filter if present
-	if testFilter != "" {
-		filterParts = append(filterParts, testFilter)
+// newRenderError creates a RenderError located at the node
+func (t *Template) newRenderError(node *TreeNode, err error) *RenderError {
+	return &RenderError{
+		Name:       node.src.name,
+		Line:       node.src.lineAt(node.pos),
+		Column:     node.src.columnAt(node.pos),
+		Tag:        node.Type,
+		Expression: node.Expression,
+		Err:        err,
+		delimiters: t.delimiters,
 	}
+}
 
-	expr := NewExpression(actualExpr)
-	value, err := expr.Evaluate(data, t.resolvePath)
+// evaluateNode evaluates the pre-parsed expression and filter chain of a node
+func (t *Template) evaluateNode(node *TreeNode, data map[string]any, ctx *renderContext) (any, error) {
+	value, err := node.expr.evaluate(data, t)
 	if err != nil {
-		return t.escapeValue("{{" + expressionStr + "!!" + err.Error() + "}}"), nil
+		return nil, err
 	}
 
-	value, err = t.applyfilters(value, filterParts, filters, data)
+	value, err = t.applyfilters(value, node.chain, ctx.filters, data)
 	if err != nil {
-		return t.escapeValue("{{" + expressionStr + "!!" + err.Error() + "}}"), nil
+		return nil, err
 	}
 
-	if rawVal, ok := value.(RawValue); ok {
-		return rawVal.Value, nil
+	if u, ok := value.(Undefined); ok {
+		return u.value()
 	}
-
-	return t.escapeValue(value), nil
+	return value, nil
 }
 
-// resolvePath resolves a dot-notation path to retrieve a value from data
+// resolvePath resolves a dot-notation path to retrieve a value from data,
+// returning an Undefined value when the path does not exist
 func (t *Template) resolvePath(path string, data map[string]any) (any, error) {
 	parts := t.explodeRespectingQuotes(".", path, -1)
 	current := any(data)
 
-	for _, part := range parts {
-		if m, ok := current.(map[string]any); ok {
-			if val, exists := m[part]; exists {
-				current = val
-			} else {
-				return nil, fmt.Errorf("path `%s` not found", part)
+	for i, part := range parts {
+		if u, ok := current.(Undefined); ok {
+			// Accessing an attribute of an undefined value
+			if t.undefinedPolicy == UndefinedLenient || t.undefinedPolicy == UndefinedDebug {
+				return nil, u.err()
 			}
-		} else {
-			return nil, fmt.Errorf("path `%s` not found", part)
+			return Undefined{Name: path, policy: t.undefinedPolicy}, nil
+		}
+		val, exists, err := lookupField(current, part)
+		if !exists && err == nil && i == 0 {
+			// Variables that are not in the scope may be fields of the root data
+			val, exists, err = lookupField(data[rootKey], part)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			current = val
+			continue
 		}
+		current = Undefined{Name: strings.Join(parts[:i+1], "."), policy: t.undefinedPolicy}
 	}
 
 	return current, nil
 }
 
 // applyfilters applies a chain of filter filters to a value
-func (t *Template) applyfilters(value any, parts []string, filters map[string]any, data map[string]any) (any, error) {
-	for _, part := range parts {
-		funcParts := t.explodeRespectingQuotes("(", strings.TrimSuffix(part, ")"), 2)
-		funcName := funcParts[0]
+func (t *Template) applyfilters(value any, chain []filterCall, filters map[string]any, data map[string]any) (any, error) {
+	for _, call := range chain {
 		var arguments []any
-
-		if len(funcParts) > 1 {
-			argStrs := t.explodeRespectingQuotes(",", funcParts[1], -1)
-			for _, argStr := range argStrs {
-				argStr = strings.TrimSpace(argStr)
-				argLen := len(argStr)
-				if argLen > 1 && argStr[0] == '"' && argStr[argLen-1] == '"' {
-					// String literal - unescape
-					unescaped := argStr[1 : argLen-1]
-					unescaped = strings.ReplaceAll(unescaped, "\\n", "\n")
-					unescaped = strings.ReplaceAll(unescaped, "\\t", "\t")
-					unescaped = strings.ReplaceAll(unescaped, "\\\"", "\"")
-					unescaped = strings.ReplaceAll(unescaped, "\\\\", "\\")
-					arguments = append(arguments, unescaped)
-				} else if argStr == "true" {
-					// Boolean literal - true
-					arguments = append(arguments, true)
-				} else if argStr == "false" {
-					// Boolean literal - false
-					arguments = append(arguments, false)
-				} else if num, err := strconv.ParseFloat(argStr, 64); err == nil {
-					// Numeric literal - convert to appropriate numeric type
-					if strings.Contains(argStr, ".") {
-						arguments = append(arguments, num) // float64
-					} else {
-						arguments = append(arguments, int(num)) // int
-					}
-				} else {
-					// Path reference
-					val, err := t.resolvePath(argStr, data)
-					if err != nil {
-						return nil, err
-					}
-					arguments = append(arguments, val)
+		for _, arg := range call.args {
+			if arg.expr == nil {
+				arguments = append(arguments, arg.value)
+				continue
+			}
+			val, err := arg.expr.evaluate(data, t)
+			if err != nil {
+				return nil, err
+			}
+			if u, ok := val.(Undefined); ok {
+				if val, err = u.value(); err != nil {
+					return nil, err
 				}
 			}
+			arguments = append(arguments, val)
+		}
+
+		// Only some filters and tests accept an undefined value
+		if u, ok := value.(Undefined); ok && !call.acceptsUndefined() {
+			var err error
+			if value, err = u.value(); err != nil {
+				return nil, err
+			}
 		}
 
 		// Prepend the value as the first argument
 		allArgs := append([]any{value}, arguments...)
 
 		// Call the function
-		if fn, exists := filters[funcName]; exists {
+		if fn, exists := filters[call.name]; exists {
 			result, err := callFunction(fn, allArgs)
 			if err != nil {
-				return nil, err
+				if call.name == "__istest__" || call.name == "__isnot__" {
+					return nil, err
+				}
+				return nil, fmt.Errorf("filter `%s`: %v", call.name, err)
 			}
 			value = result
 		} else {
-			return nil, fmt.Errorf("filter `%s` not found", funcName)
+			return nil, fmt.Errorf("filter `%s` not found", call.name)
 		}
 	}
 
 	return value, nil
 }
 
-// renderIncludeNode renders an 'include' node by loading and rendering another template
-func (t *Template) renderIncludeNode(node *TreeNode, data map[string]any, filters map[string]any) (string, error) {
-	if t.loader == nil {
-		return "", fmt.Errorf("template loader not configured for include directive")
+// renderIncludeNode renders an 'include' node using the template compiled along with it
+func (t *Template) renderIncludeNode(w io.Writer, node *TreeNode, data map[string]any, ctx *renderContext) error {
+	if node.err != nil {
+		return t.includeError(w, node, node.err)
+	}
+	if ctx.depth >= t.maxIncludeDepth {
+		return t.includeError(w, node, fmt.Errorf("maximum include depth of %d exceeded", t.maxIncludeDepth))
 	}
 
-	// Get the template name from include expression
-	templateName := strings.Trim(node.Expression, "'\"")
+	// Render the included template with the same data and filters, variables
+	// set in the included template do not affect the including template
+	ctx.depth++
+	defer func() { ctx.depth-- }()
+	return t.renderChildren(w, node.include, copyMap(data), ctx)
+}
 
-	// Load the included template
-	templateContent, err := t.loader(templateName)
+// includeError handles an error loading or nesting an included template. It
+// is returned as is in inline mode, as a missing template is not an error in
+// an expression, and handled like other render errors in the other modes.
+func (t *Template) includeError(w io.Writer, node *TreeNode, err error) error {
+	if t.errorMode == ErrorModeInline {
+		return err
+	}
+	return t.renderError(w, node, err)
+}
+
+// renderSetNode assigns the value of an expression, or the rendered content
+// of the node, to a variable in the current scope
+func (t *Template) renderSetNode(w io.Writer, node *TreeNode, data map[string]any, ctx *renderContext) error {
+	var value any
+	var err error
+	if node.expr != nil {
+		value, err = t.evaluateAssignment(node, data, ctx)
+	} else {
+		var sb strings.Builder
+		if err := t.renderChildren(&sb, node, data, ctx); err != nil {
+			return err
+		}
+		value, err = t.applyfilters(sb.String(), node.chain, ctx.filters, data)
+		// The captured content is already escaped
+		if str, ok := value.(string); ok {
+			value = RawValue{Value: str}
+		}
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to load included template '%s': %v", templateName, err)
+		return t.renderError(w, node, err)
 	}
+	data[node.target] = value
+	return nil
+}
 
-	// Parse and render the included template
-	tokens := t.tokenize(templateContent)
-	tree := t.createSyntaxTree(tokens)
+// renderWithNode renders the children of a 'with' node in a new scope with
+// the assigned variables, which are evaluated in the enclosing scope
+func (t *Template) renderWithNode(w io.Writer, node *TreeNode, data map[string]any, ctx *renderContext) error {
+	scope := copyMap(data)
+	for _, assign := range node.assigns {
+		value, err := t.evaluateAssignment(assign, data, ctx)
+		if err != nil {
+			return t.renderError(w, node, err)
+		}
+		scope[assign.target] = value
+	}
+	return t.renderChildren(w, node, scope, ctx)
+}
 
-	// Render the included template with the same data and filters
-	return t.renderChildren(tree, data, filters)
+// evaluateAssignment evaluates the expression of an assignment, keeping an
+// undefined value undefined, unless the policy forbids its use
+func (t *Template) evaluateAssignment(node *TreeNode, data map[string]any, ctx *renderContext) (any, error) {
+	value, err := node.expr.evaluate(data, t)
+	if err != nil {
+		return nil, err
+	}
+	value, err = t.applyfilters(value, node.chain, ctx.filters, data)
+	if err != nil {
+		return nil, err
+	}
+	if u, ok := value.(Undefined); ok {
+		if _, err := u.value(); err != nil {
+			return nil, err
+		}
+	}
+	return value, nil
 }
@@ -1,15 +1,11 @@
 package tqtemplate
 
 import (
+	"fmt"
 	"reflect"
 	"strings"
 )
 
-// undefinedSentinel is a sentinel type to distinguish between nil and undefined
-type undefinedSentinel struct{}
-
-var undefinedValue = &undefinedSentinel{}
-
 // getBuiltinTests returns all builtin tests for the template engine
 func getBuiltinTests() map[string]any {
 	return map[string]any{
@@ -26,10 +22,10 @@ func getBuiltinTests() map[string]any {
 }
 
 // createFilterIsTest creates a filterIsTest function with access to all tests (builtin and custom)
-func createFilterIsTest(allTests map[string]any) func(any, ...any) bool {
-	return func(value any, args ...any) bool {
+func createFilterIsTest(allTests map[string]any) func(any, ...any) (bool, error) {
+	return func(value any, args ...any) (bool, error) {
 		if len(args) == 0 {
-			return false
+			return false, nil
 		}
 
 		// First arg is the test name
@@ -38,54 +34,30 @@ func createFilterIsTest(allTests map[string]any) func(any, ...any) bool {
 		// Get the test function from all available tests
 		testFn, exists := allTests[testName]
 		if !exists {
-			return false
+			return false, fmt.Errorf("test `%s` not found", testName)
 		}
 
-		// Call the test with remaining args
-		remaining := args[1:]
-
-		// Type switch on test function signature
-		switch fn := testFn.(type) {
-		case func(any) bool:
-			return fn(value)
-		case func(any, ...any) bool:
-			return fn(value, remaining...)
-		case func(any, any) bool:
-			// Custom test with one argument
-			if len(remaining) > 0 {
-				return fn(value, remaining[0])
-			}
-			return false
-		case func(any, any, any) bool:
-			// Custom test with two arguments
-			if len(remaining) >= 2 {
-				return fn(value, remaining[0], remaining[1])
-			}
-			return false
-		case func(any, any, any, any) bool:
-			// Custom test with three arguments
-			if len(remaining) >= 3 {
-				return fn(value, remaining[0], remaining[1], remaining[2])
-			}
-			return false
-		default:
-			return false
+		// Call the test with the value and remaining args
+		result, err := callFunction(testFn, append([]any{value}, args[1:]...))
+		if err != nil {
+			return false, fmt.Errorf("test `%s`: %v", testName, err)
 		}
+		return toBool(result), nil
 	}
 }
 
 // createFilterIsNot creates a filterIsNot function with access to all tests (builtin and custom)
-func createFilterIsNot(allTests map[string]any) func(any, ...any) bool {
-	return func(value any, args ...any) bool {
-		filterIsTest := createFilterIsTest(allTests)
-		return !filterIsTest(value, args...)
+func createFilterIsNot(allTests map[string]any) func(any, ...any) (bool, error) {
+	filterIsTest := createFilterIsTest(allTests)
+	return func(value any, args ...any) (bool, error) {
+		result, err := filterIsTest(value, args...)
+		return !result, err
 	}
 }
 
 // testDefined returns true if the value is not undefined (even if it's nil)
 func testDefined(value any) bool {
-	// Check if it's the undefined sentinel
-	if _, isUndefined := value.(*undefinedSentinel); isUndefined {
+	if _, isUndefined := value.(Undefined); isUndefined {
 		return false
 	}
 	// nil is still defined if the variable exists in the data
@@ -94,8 +66,7 @@ func testDefined(value any) bool {
 
 // testUndefined returns true if the value is undefined (not just nil)
 func testUndefined(value any) bool {
-	// Check if it's the undefined sentinel
-	_, isUndefined := value.(*undefinedSentinel)
+	_, isUndefined := value.(Undefined)
 	return isUndefined
 }
 
@@ -141,6 +112,9 @@ func testIterable(value any) bool {
 	if value == nil {
 		return false
 	}
+	if _, ok := value.(*OrderedMap); ok {
+		return true
+	}
 
 	v := reflect.ValueOf(value)
 	kind := v.Kind()
@@ -148,7 +122,9 @@ func testIterable(value any) bool {
 	return kind == reflect.Slice ||
 		kind == reflect.Array ||
 		kind == reflect.Map ||
-		kind == reflect.String
+		kind == reflect.String ||
+		kind == reflect.Chan ||
+		isIterator(v.Type())
 }
 
 // testNull returns true if the value is nil
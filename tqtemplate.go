@@ -1,9 +1,10 @@
 package tqtemplate
 
 import (
-	"fmt"
 	"html"
+	"io"
 	"strings"
+	"sync"
 	"unicode/utf8"
 )
 
@@ -17,106 +18,304 @@ type TreeNode struct {
 	Type       string
 	Expression string
 	Children   []*TreeNode
-	Value      any
+
+	// location in the template source
+	src *source
+	pos int
+
+	// pre-parsed at compile time
+	expr     *Expression
+	chain    []filterCall
+	forKey   string
+	forValue string
+	forCond  *TreeNode
+	target   string
+	assigns  []*TreeNode
+	include  *TreeNode
+	err      error
+
+	recursive bool // a recursive 'for' loop
+	recurse   bool // a 'var' node with a loop(items) call
 }
 
 // TemplateLoader is a function that loads template content by name
 type TemplateLoader func(name string) (string, error)
 
+// ErrorMode determines how errors evaluating tags are handled while rendering
+type ErrorMode int
+
+const (
+	// ErrorModeInline renders errors as escaped text in the output (default)
+	ErrorModeInline ErrorMode = iota
+	// ErrorModeStrict aborts rendering and returns a *RenderError
+	ErrorModeStrict
+	// ErrorModeLenient renders nothing for the tag and reports a warning
+	ErrorModeLenient
+)
+
+// WarningHandler receives the errors that are skipped in ErrorModeLenient
+type WarningHandler func(err *RenderError)
+
+// EscapeMode determines how values are escaped in the output
+type EscapeMode int
+
+const (
+	// EscapeHTML escapes values for use in HTML (default)
+	EscapeHTML EscapeMode = iota
+	// EscapeNone outputs values as they are, for plain text output
+	EscapeNone
+)
+
+// defaultMaxIncludeDepth is the maximum depth of nested includes if not configured
+const defaultMaxIncludeDepth = 100
+
+// Options configures a template engine, the zero value uses the defaults
+type Options struct {
+	Loader          TemplateLoader  // loads templates for RenderFile, extends and include
+	Filters         map[string]any  // custom filters, overriding builtin filters
+	Tests           map[string]any  // custom tests, overriding builtin tests
+	Globals         map[string]any  // variables available in every render
+	Escape          EscapeMode      // how values are escaped in the output
+	Undefined       UndefinedPolicy // how undefined variables are handled
+	ErrorMode       ErrorMode       // how errors evaluating tags are handled
+	WarningHandler  WarningHandler  // receives the errors skipped in ErrorModeLenient
+	MaxIncludeDepth int             // maximum depth of nested includes and loops, 0 for 100
+	MaxOutputSize   int             // maximum size of the output in bytes, 0 for no limit
+
+	// Whitespace handling of tags and comments on standalone lines, which by
+	// default are removed together with their indentation and newline
+	KeepTagIndent      bool // keep the indentation before standalone tags and comments
+	KeepTagNewline     bool // keep the newline after standalone tags
+	KeepCommentNewline bool // keep the newline after standalone comments
+
+	Delimiters Delimiters // delimiters of variables, tags and comments
+}
+
+// Delimiters are the strings that start and end variables, tags and comments.
+// Empty fields use the default delimiters.
+type Delimiters struct {
+	VariableStart string // default "{{"
+	VariableEnd   string // default "}}"
+	BlockStart    string // default "{%"
+	BlockEnd      string // default "%}"
+	CommentStart  string // default "{#"
+	CommentEnd    string // default "#}"
+}
+
+// withDefaults returns the delimiters with the empty fields set to the defaults
+func (d Delimiters) withDefaults() Delimiters {
+	defaults := []struct {
+		field *string
+		value string
+	}{
+		{&d.VariableStart, "{{"}, {&d.VariableEnd, "}}"},
+		{&d.BlockStart, "{%"}, {&d.BlockEnd, "%}"},
+		{&d.CommentStart, "{#"}, {&d.CommentEnd, "#}"},
+	}
+	for _, def := range defaults {
+		if *def.field == "" {
+			*def.field = def.value
+		}
+	}
+	return d
+}
+
+// tagKind is the kind of tag that a start delimiter opens
+type tagKind int
+
+const (
+	noTag tagKind = iota
+	commentTag
+	blockTag
+	variableTag
+)
+
+// tagAt returns the kind of tag that starts at the beginning of the string,
+// preferring the longest start delimiter when more than one matches
+func (d *Delimiters) tagAt(str string) tagKind {
+	kind, longest := noTag, 0
+	starts := [...]struct {
+		kind  tagKind
+		start string
+	}{
+		{commentTag, d.CommentStart},
+		{blockTag, d.BlockStart},
+		{variableTag, d.VariableStart},
+	}
+	for _, s := range starts {
+		if len(s.start) > longest && strings.HasPrefix(str, s.start) {
+			kind, longest = s.kind, len(s.start)
+		}
+	}
+	return kind
+}
+
 // Template is the main template engine
 type Template struct {
-	loader  TemplateLoader
-	filters map[string]any
-	tests   map[string]any
+	mu              sync.RWMutex
+	loader          TemplateLoader
+	filters         map[string]any
+	tests           map[string]any
+	globals         map[string]any
+	escapeMode      EscapeMode
+	errorMode       ErrorMode
+	warningHandler  WarningHandler
+	undefinedPolicy UndefinedPolicy
+	maxIncludeDepth int
+	maxOutputSize   int
+	whitespace      whitespaceOptions
+	delimiters      Delimiters
+}
+
+// whitespaceOptions controls the whitespace removal of standalone lines
+type whitespaceOptions struct {
+	keepTagIndent      bool
+	keepTagNewline     bool
+	keepCommentNewline bool
+}
+
+// New creates a new template engine with the given options
+func New(options Options) *Template {
+	return &Template{
+		loader:          options.Loader,
+		filters:         copyMap(options.Filters),
+		tests:           copyMap(options.Tests),
+		globals:         copyMap(options.Globals),
+		escapeMode:      options.Escape,
+		errorMode:       options.ErrorMode,
+		warningHandler:  options.WarningHandler,
+		undefinedPolicy: options.Undefined,
+		maxIncludeDepth: options.MaxIncludeDepth,
+		maxOutputSize:   options.MaxOutputSize,
+		whitespace: whitespaceOptions{
+			keepTagIndent:      options.KeepTagIndent,
+			keepTagNewline:     options.KeepTagNewline,
+			keepCommentNewline: options.KeepCommentNewline,
+		},
+		delimiters: options.Delimiters,
+	}
+}
+
+// snapshot returns a copy of the engine with its current configuration and
+// the defaults applied, so that the zero value of Template can be used
+func (t *Template) snapshot() *Template {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	maxIncludeDepth := t.maxIncludeDepth
+	if maxIncludeDepth <= 0 {
+		maxIncludeDepth = defaultMaxIncludeDepth
+	}
+	return &Template{
+		loader:          t.loader,
+		filters:         copyMap(t.filters),
+		tests:           copyMap(t.tests),
+		globals:         copyMap(t.globals),
+		escapeMode:      t.escapeMode,
+		errorMode:       t.errorMode,
+		warningHandler:  t.warningHandler,
+		undefinedPolicy: t.undefinedPolicy,
+		maxIncludeDepth: maxIncludeDepth,
+		maxOutputSize:   t.maxOutputSize,
+		whitespace:      t.whitespace,
+		delimiters:      t.delimiters.withDefaults(),
+	}
 }
 
 // NewTemplate creates a new template engine
 func NewTemplate() *Template {
-	return NewTemplateWithLoaderAndFiltersAndTests(nil, nil, nil)
+	return New(Options{})
 }
 
 // NewTemplateWithLoader creates a new template engine with a custom template loader
 func NewTemplateWithLoader(loader TemplateLoader) *Template {
-	return NewTemplateWithLoaderAndFiltersAndTests(loader, nil, nil)
-
+	return New(Options{Loader: loader})
 }
 
-// NewTemplateWithLoader creates a new template engine with a custom template loader
+// NewTemplateWithLoaderAndFilters creates a new template engine with a custom template loader and filters
 func NewTemplateWithLoaderAndFilters(loader TemplateLoader, customFilters map[string]any) *Template {
-	return NewTemplateWithLoaderAndFiltersAndTests(loader, customFilters, nil)
+	return New(Options{Loader: loader, Filters: customFilters})
 }
 
+// NewTemplateWithLoaderAndFiltersAndTests creates a new template engine with a custom template loader, filters and tests
 func NewTemplateWithLoaderAndFiltersAndTests(loader TemplateLoader, customFilters map[string]any, customTests map[string]any) *Template {
-	return &Template{
-		loader:  loader,
-		filters: customFilters,
-		tests:   customTests,
-	}
+	return New(Options{Loader: loader, Filters: customFilters, Tests: customTests})
+}
+
+// SetErrorMode sets how errors evaluating tags are handled while rendering
+func (t *Template) SetErrorMode(mode ErrorMode) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.errorMode = mode
+}
+
+// SetWarningHandler sets the function that receives errors in ErrorModeLenient
+func (t *Template) SetWarningHandler(handler WarningHandler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.warningHandler = handler
+}
+
+// SetUndefinedPolicy sets how variables and paths that do not exist are handled
+func (t *Template) SetUndefinedPolicy(policy UndefinedPolicy) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.undefinedPolicy = policy
 }
 
 // RenderFile renders a template file with the provided data
 func (t *Template) RenderFile(templateFile string, data map[string]any) (string, error) {
-	if t.loader == nil {
-		return "", fmt.Errorf("no template loader defined")
-	}
-	templateContent, err := t.loader(templateFile)
-	if err != nil {
+	var sb strings.Builder
+	if err := t.RenderFileTo(&sb, templateFile, data); err != nil {
 		return "", err
 	}
-	return t.Render(templateContent, data)
+	return sb.String(), nil
 }
 
-// Render renders a template string with the provided data
-func (t *Template) Render(template string, data map[string]any) (string, error) {
-	tokens := t.tokenize(template)
-	tree := t.createSyntaxTree(tokens)
-
-	// Initialize filters map if needed
-	filters := make(map[string]any)
-
-	// Register all builtin filters
-	builtins := getBuiltinFilters()
-	for name, fn := range builtins {
-		filters[name] = fn
+// RenderFileTo renders a template file with the provided data to a writer
+func (t *Template) RenderFileTo(w io.Writer, templateFile string, data map[string]any) error {
+	compiled, err := t.CompileFile(templateFile)
+	if err != nil {
+		return err
 	}
+	return compiled.RenderTo(w, data)
+}
 
-	// Collect all tests (builtin + custom)
-	allTests := make(map[string]any)
-
-	// Register all builtin tests
-	tests := getBuiltinTests()
-	for name, fn := range tests {
-		allTests[name] = fn
-		filters[name] = fn
+// RenderFileAny renders a template file with data that is a struct, a pointer
+// to a struct or a map with string keys
+func (t *Template) RenderFileAny(templateFile string, data any) (string, error) {
+	compiled, err := t.CompileFile(templateFile)
+	if err != nil {
+		return "", err
 	}
+	return compiled.RenderAny(data)
+}
 
-	// Add custom tests (allow user overrides)
-	if t.tests != nil {
-		for name, fn := range t.tests {
-			allTests[name] = fn
-			filters[name] = fn
-		}
+// Render renders a template string with the provided data
+func (t *Template) Render(template string, data map[string]any) (string, error) {
+	var sb strings.Builder
+	if err := t.RenderTo(&sb, template, data); err != nil {
+		return "", err
 	}
+	return sb.String(), nil
+}
 
-	// Create __istest__ and __isnot__ filters with access to all tests
-	filters["__istest__"] = createFilterIsTest(allTests)
-	filters["__isnot__"] = createFilterIsNot(allTests)
-
-	// Add custom filters (allow user overrides)
-	if t.filters != nil {
-		for name, fn := range t.filters {
-			filters[name] = fn
-		}
+// RenderTo renders a template string with the provided data to a writer
+func (t *Template) RenderTo(w io.Writer, template string, data map[string]any) error {
+	compiled, err := t.Compile(template)
+	if err != nil {
+		return err
 	}
+	return compiled.RenderTo(w, data)
+}
 
-	// Check if this template extends another template
-	// Extends must be the first non-literal node
-	extendsNode := t.findExtendsNode(tree)
-	if extendsNode != nil {
-		return t.renderWithExtends(tree, extendsNode, data, filters)
+// RenderAny renders a template string with data that is a struct, a pointer
+// to a struct or a map with string keys
+func (t *Template) RenderAny(template string, data any) (string, error) {
+	compiled, err := t.Compile(template)
+	if err != nil {
+		return "", err
 	}
-
-	return t.renderChildren(tree, data, filters)
+	return compiled.RenderAny(data)
 }
 
 // escapeValue escapes a value for HTML output
@@ -125,106 +324,85 @@ func (t *Template) escapeValue(value any) string {
 		return rawVal.Value
 	}
 	str := toString(value)
+	if t.escapeMode == EscapeNone {
+		return str
+	}
 	return html.EscapeString(str)
 }
 
+// writeEscaped writes a value to the writer, escaped for HTML output
+func (t *Template) writeEscaped(w io.Writer, value any) error {
+	_, err := io.WriteString(w, t.escapeValue(value))
+	return err
+}
+
+// token is a literal text or expression with its byte offset in the template
+type token struct {
+	value string
+	pos   int
+}
+
 // tokenize splits a template into literal text and expressions
-func (t *Template) tokenize(template string) []string {
-	tokens := []string{}
+func (t *Template) tokenize(src *source) ([]token, error) {
+	template := src.text
+	d := &t.delimiters
+	tokens := []token{}
 	i := 0
 	length := len(template)
 	literal := ""
+	literalPos := 0
 
 	for i < length {
-		// Check for comment {#
-		if i < length-1 && template[i] == '{' && template[i+1] == '#' {
-			// Check if this comment is on a standalone line
-			lineStart := strings.LastIndex(literal, "\n")
-			beforeTag := ""
-			isStandaloneLine := false
-
-			if lineStart == -1 {
-				beforeTag = literal
-				isStandaloneLine = literal == "" || (i == len(beforeTag) && strings.TrimSpace(beforeTag) == "")
-			} else {
-				beforeTag = literal[lineStart+1:]
-				isStandaloneLine = strings.TrimSpace(beforeTag) == ""
+		switch d.tagAt(template[i:]) {
+		case commentTag:
+			start := i
+			var standalone bool
+			literal, standalone = trimBeforeTag(literal, start == len(literal), tagModifier(template, start+len(d.CommentStart)), !t.whitespace.keepTagIndent)
+
+			// Skip the comment - find the comment end delimiter
+			end := strings.Index(template[start+len(d.CommentStart):], d.CommentEnd)
+			if end == -1 {
+				return nil, src.errorAt(start, "unterminated comment, expected `%s`", d.CommentEnd)
 			}
-
-			// If standalone, remove just the whitespace on this line
-			if isStandaloneLine && lineStart != -1 {
-				literal = literal[:lineStart+1]
-			} else if isStandaloneLine && lineStart == -1 {
-				literal = ""
+			end += start + len(d.CommentStart)
+			right := byte(0)
+			if end > start+len(d.CommentStart) {
+				right = tagModifier(template, end-1)
 			}
 
-			// Skip the comment - find closing #}
-			i += 2
-			commentEnd := i
-			for commentEnd < length-1 {
-				if template[commentEnd] == '#' && template[commentEnd+1] == '}' {
-					commentEnd += 2
-					break
-				}
-				commentEnd++
-			}
-
-			// If standalone line, consume trailing newline after comment
-			if isStandaloneLine && commentEnd < length && template[commentEnd] == '\n' {
-				commentEnd++
-			} else if isStandaloneLine && commentEnd < length-1 && template[commentEnd] == '\r' && template[commentEnd+1] == '\n' {
-				commentEnd += 2
-			}
-
-			i = commentEnd
+			i = trimAfterTag(template, end+len(d.CommentEnd), right, standalone && !t.whitespace.keepCommentNewline)
 			continue
-		}
 
-		// Check for control structure {%
-		if i < length-1 && template[i] == '{' && template[i+1] == '%' {
-			// Check if this control structure is on a standalone line
-			lineStart := strings.LastIndex(literal, "\n")
-			beforeTag := ""
-			isStandaloneLine := false
-
-			if lineStart == -1 {
-				beforeTag = literal
-				isStandaloneLine = literal == "" || (i == len(beforeTag) && strings.TrimSpace(beforeTag) == "")
-			} else {
-				beforeTag = literal[lineStart+1:]
-				isStandaloneLine = strings.TrimSpace(beforeTag) == ""
-			}
-
-			// If standalone, remove just the whitespace on this line
-			if isStandaloneLine && lineStart != -1 {
-				literal = literal[:lineStart+1]
-			} else if isStandaloneLine && lineStart == -1 {
-				literal = ""
-			}
+		case blockTag:
+			start := i
+			left := tagModifier(template, start+len(d.BlockStart))
+			var standalone bool
+			literal, standalone = trimBeforeTag(literal, start == len(literal), left, !t.whitespace.keepTagIndent)
 
-			tokens = append(tokens, literal)
+			tokens = append(tokens, token{value: literal, pos: literalPos})
 			literal = ""
-			i += 2
+			i += len(d.BlockStart)
+			if left != 0 {
+				i++
+			}
 			expr := ""
 			quoted := false
 			escaped := false
-			for i < length-1 {
+			closed := false
+			for i < length {
 				r, size := utf8.DecodeRuneInString(template[i:])
 				if !escaped {
 					if r == '"' {
 						quoted = !quoted
 					} else if r == '\\' {
 						escaped = true
-					} else if !quoted && r == '%' && i+1 < length && template[i+1] == '}' {
-						tokens = append(tokens, "@"+strings.TrimSpace(expr))
-						i += 2
-
-						// If standalone line, consume trailing newline
-						if isStandaloneLine && i < length && template[i] == '\n' {
-							i++
-						} else if isStandaloneLine && i < length-1 && template[i] == '\r' && template[i+1] == '\n' {
-							i += 2
+					} else if !quoted && strings.HasPrefix(template[i:], d.BlockEnd) {
+						right := tagModifier(expr, len(expr)-1)
+						if right != 0 {
+							expr = expr[:len(expr)-1]
 						}
+						i = trimAfterTag(template, i+len(d.BlockEnd), right, standalone && !t.whitespace.keepTagNewline)
+						closed = true
 						break
 					}
 				} else {
@@ -233,27 +411,68 @@ func (t *Template) tokenize(template string) []string {
 				expr += string(r)
 				i += size
 			}
+			if !closed {
+				return nil, src.errorAt(start, "unterminated tag, expected `%s`", d.BlockEnd)
+			}
+
+			if strings.TrimSpace(expr) == "raw" {
+				// The content up to endraw is literal text, so continue the
+				// literal that preceded the raw tag
+				last := tokens[len(tokens)-1]
+				tokens = tokens[:len(tokens)-1]
+				literal, literalPos = last.value, last.pos
+
+				endStart, endEnd, endLeft, endRight := d.findEndRaw(template, i)
+				if endStart == -1 {
+					return nil, src.errorAt(start, "unclosed `raw`, expected `endraw`")
+				}
+				atLineStart := i == 0 || template[i-1] == '\n'
+				content, standalone := trimBeforeTag(template[i:endStart], atLineStart, endLeft, !t.whitespace.keepTagIndent)
+				if literal == "" {
+					literalPos = i
+				}
+				literal += content
+				i = trimAfterTag(template, endEnd, endRight, standalone && !t.whitespace.keepTagNewline)
+				continue
+			}
+
+			tokens = append(tokens, token{value: "@" + strings.TrimSpace(expr), pos: start})
 			continue
-		}
 
-		// Check for variable {{
-		if i < length-1 && template[i] == '{' && template[i+1] == '{' {
-			tokens = append(tokens, literal)
+		case variableTag:
+			start := i
+			left := tagModifier(template, start+len(d.VariableStart))
+			if left == '-' {
+				literal = strings.TrimRight(literal, whitespace)
+			}
+
+			tokens = append(tokens, token{value: literal, pos: literalPos})
 			literal = ""
-			i += 2
+			i += len(d.VariableStart)
+			if left == '-' {
+				i++
+			}
 			expr := ""
 			quoted := false
 			escaped := false
-			for i < length-1 {
+			closed := false
+			for i < length {
 				r, size := utf8.DecodeRuneInString(template[i:])
 				if !escaped {
 					if r == '"' {
 						quoted = !quoted
 					} else if r == '\\' {
 						escaped = true
-					} else if !quoted && r == '}' && i+1 < length && template[i+1] == '}' {
-						tokens = append(tokens, strings.TrimSpace(expr))
-						i += 2
+					} else if !quoted && strings.HasPrefix(template[i:], d.VariableEnd) {
+						right := tagModifier(expr, len(expr)-1)
+						if right == '-' {
+							expr = expr[:len(expr)-1]
+						} else {
+							right = 0
+						}
+						tokens = append(tokens, token{value: strings.TrimSpace(expr), pos: start})
+						i = trimAfterTag(template, i+len(d.VariableEnd), right, false)
+						closed = true
 						break
 					}
 				} else {
@@ -262,17 +481,111 @@ func (t *Template) tokenize(template string) []string {
 				expr += string(r)
 				i += size
 			}
+			if !closed {
+				return nil, src.errorAt(start, "unterminated variable, expected `%s`", d.VariableEnd)
+			}
 			continue
 		}
 
 		// Regular character - read full UTF-8 rune
 		r, size := utf8.DecodeRuneInString(template[i:])
+		if literal == "" {
+			literalPos = i
+		}
 		literal += string(r)
 		i += size
 	}
 
-	tokens = append(tokens, literal)
-	return tokens
+	tokens = append(tokens, token{value: literal, pos: literalPos})
+	return tokens, nil
+}
+
+// whitespace are the characters removed by the '-' whitespace control modifier
+const whitespace = " \t\r\n"
+
+// tagModifier returns the whitespace control modifier ('-' or '+') at a
+// position in the string, or 0 if there is none
+func tagModifier(str string, i int) byte {
+	if i >= 0 && i < len(str) && (str[i] == '-' || str[i] == '+') {
+		return str[i]
+	}
+	return 0
+}
+
+// trimBeforeTag removes the whitespace before a tag from the literal: all of
+// it for the '-' modifier, or the indentation when the tag is on a standalone
+// line and stripIndent is set, unless the '+' modifier is used. It also reports
+// whether the tag is on a standalone line (only preceded by whitespace).
+// The atLineStart argument tells whether the literal starts at a line start.
+func trimBeforeTag(literal string, atLineStart bool, modifier byte, stripIndent bool) (string, bool) {
+	lineStart := strings.LastIndex(literal, "\n")
+	standalone := false
+	if lineStart == -1 {
+		standalone = literal == "" || (atLineStart && strings.TrimSpace(literal) == "")
+	} else {
+		standalone = strings.TrimSpace(literal[lineStart+1:]) == ""
+	}
+
+	switch {
+	case modifier == '-':
+		literal = strings.TrimRight(literal, whitespace)
+	case modifier == '+' || !standalone || !stripIndent:
+		// Keep the whitespace
+	default:
+		// Remove just the whitespace on this line
+		literal = literal[:lineStart+1]
+	}
+	return literal, standalone
+}
+
+// findEndRaw finds the first endraw tag from position i, returning its start
+// and end position and its whitespace control modifiers, or -1 if not found
+func (d *Delimiters) findEndRaw(template string, i int) (int, int, byte, byte) {
+	for {
+		open := strings.Index(template[i:], d.BlockStart)
+		if open == -1 {
+			return -1, -1, 0, 0
+		}
+		open += i
+		end := strings.Index(template[open+len(d.BlockStart):], d.BlockEnd)
+		if end == -1 {
+			return -1, -1, 0, 0
+		}
+		end += open + len(d.BlockStart)
+
+		expr := template[open+len(d.BlockStart) : end]
+		left := tagModifier(expr, 0)
+		if left != 0 {
+			expr = expr[1:]
+		}
+		right := tagModifier(expr, len(expr)-1)
+		if right != 0 {
+			expr = expr[:len(expr)-1]
+		}
+		if strings.TrimSpace(expr) == "endraw" {
+			return open, end + len(d.BlockEnd), left, right
+		}
+		i = open + len(d.BlockStart)
+	}
+}
+
+// trimAfterTag returns the position after the whitespace that follows a tag:
+// all of it for the '-' modifier, or the newline when stripNewline is set,
+// unless the '+' modifier is used
+func trimAfterTag(template string, i int, modifier byte, stripNewline bool) int {
+	switch {
+	case modifier == '-':
+		for i < len(template) && strings.IndexByte(whitespace, template[i]) != -1 {
+			i++
+		}
+	case modifier == '+' || !stripNewline:
+		// Keep the whitespace
+	case strings.HasPrefix(template[i:], "\n"):
+		i++
+	case strings.HasPrefix(template[i:], "\r\n"):
+		i += 2
+	}
+	return i
 }
 
 // explodeRespectingQuotes splits a string by separator, respecting quoted substrings
@@ -327,13 +640,29 @@ func (t *Template) explodeRespectingQuotes(separator, str string, count int) []s
 	return tokens
 }
 
+// closeTags maps each block node type to the tag that closes it
+var closeTags = map[string]string{
+	"if":      "endif",
+	"elseif":  "endif",
+	"else":    "endif",
+	"for":     "endfor",
+	"forelse": "endfor",
+	"block":   "endblock",
+	"set":     "endset",
+	"with":    "endwith",
+}
+
 // createSyntaxTree creates an abstract syntax tree from tokens
-func (t *Template) createSyntaxTree(tokens []string) *TreeNode {
-	root := &TreeNode{Type: "root"}
+func (t *Template) createSyntaxTree(src *source, tokens []token) (*TreeNode, error) {
+	root := &TreeNode{Type: "root", src: src}
 	current := root
 	stack := []*TreeNode{}
+	errs := TemplateErrors{}
+	blockNames := map[string]int{}
+	hasContent := false
 
-	for i, token := range tokens {
+	for i, tok := range tokens {
+		token := tok.value
 		if i%2 == 1 {
 			// Control structures are prefixed with @
 			isControl := strings.HasPrefix(token, "@")
@@ -350,6 +679,22 @@ func (t *Template) createSyntaxTree(tokens []string) *TreeNode {
 				nodeType = "endfor"
 			} else if token == "endblock" {
 				nodeType = "endblock"
+			} else if token == "endset" {
+				nodeType = "endset"
+			} else if token == "endwith" {
+				nodeType = "endwith"
+			} else if token == "with" {
+				nodeType = "with"
+			} else if token == "break" || token == "continue" {
+				nodeType = token
+			} else if strings.HasPrefix(token, "break if ") {
+				nodeType = "break"
+				expression = strings.TrimSpace(token[9:])
+			} else if strings.HasPrefix(token, "continue if ") {
+				nodeType = "continue"
+				expression = strings.TrimSpace(token[12:])
+			} else if token == "endraw" {
+				nodeType = "endraw"
 			} else if token == "else" {
 				nodeType = "else"
 			} else if strings.HasPrefix(token, "elseif ") {
@@ -370,38 +715,139 @@ func (t *Template) createSyntaxTree(tokens []string) *TreeNode {
 			} else if strings.HasPrefix(token, "include ") {
 				nodeType = "include"
 				expression = strings.TrimSpace(token[8:])
+			} else if strings.HasPrefix(token, "set ") {
+				nodeType = "set"
+				expression = strings.TrimSpace(token[4:])
+			} else if strings.HasPrefix(token, "with ") {
+				nodeType = "with"
+				expression = strings.TrimSpace(token[5:])
 			} else {
 				nodeType = "var"
 				expression = token
 			}
 
-			if nodeType == "endif" || nodeType == "endfor" || nodeType == "endblock" || nodeType == "elseif" || nodeType == "else" {
-				if len(stack) > 0 {
-					current = stack[len(stack)-1]
-					stack = stack[:len(stack)-1]
+			if isControl && nodeType == "var" {
+				// A tag is never a variable, report it instead of rendering it as one
+				name, _, _ := strings.Cut(token, " ")
+				switch name {
+				case "":
+					errs = append(errs, src.errorAt(tok.pos, "empty tag"))
+				case "if", "elseif", "for", "block", "extends", "include", "set":
+					errs = append(errs, src.errorAt(tok.pos, "missing expression in `%s`", name))
+				default:
+					errs = append(errs, src.errorAt(tok.pos, "unknown tag `%s`", name))
+				}
+				continue
+			}
+
+			switch nodeType {
+			case "endraw":
+				// Raw blocks are handled by the tokenizer, including their endraw
+				errs = append(errs, src.errorAt(tok.pos, "unexpected `endraw` outside of `raw`"))
+				continue
+			case "endif", "endfor", "endblock", "endset", "endwith":
+				if len(stack) == 0 {
+					errs = append(errs, src.errorAt(tok.pos, "unexpected `%s`, no open block to close", nodeType))
+					continue
+				}
+				if closeTags[current.Type] != nodeType {
+					errs = append(errs, src.errorAt(tok.pos, "unexpected `%s`, expected `%s`", nodeType, closeTags[current.Type]))
+					// Recover by closing up to a matching block, if there is one
+					depth := len(stack) - 1
+					for depth > 0 && closeTags[stack[depth].Type] != nodeType {
+						depth--
+					}
+					if depth == 0 {
+						continue
+					}
+					current = stack[depth]
+					stack = stack[:depth]
+				}
+				current = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			case "else":
+				if current.Type == "for" {
+					// The else of a loop is its last child, which is closed by endfor
+					node := &TreeNode{Type: "forelse", src: src, pos: tok.pos}
+					current.Children = append(current.Children, node)
+					current = node
+					hasContent = true
+					continue
+				}
+				if current.Type != "if" && current.Type != "elseif" {
+					errs = append(errs, src.errorAt(tok.pos, "unexpected `%s` outside of `if` or `for`", nodeType))
+					continue
+				}
+				current = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			case "elseif":
+				if current.Type != "if" && current.Type != "elseif" {
+					errs = append(errs, src.errorAt(tok.pos, "unexpected `%s` outside of `if`", nodeType))
+					continue
+				}
+				current = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			case "block":
+				if pos, exists := blockNames[expression]; exists {
+					errs = append(errs, src.errorAt(tok.pos, "duplicate block `%s`, already defined on line %d", expression, src.lineAt(pos)))
+				} else {
+					blockNames[expression] = tok.pos
+				}
+			case "break", "continue":
+				inLoop := current.Type == "for"
+				for _, node := range stack {
+					inLoop = inLoop || node.Type == "for"
+				}
+				if !inLoop {
+					errs = append(errs, src.errorAt(tok.pos, "unexpected `%s` outside of `for`", nodeType))
+					continue
+				}
+			case "extends":
+				if current != root || hasContent {
+					errs = append(errs, src.errorAt(tok.pos, "`extends` must be the first tag in the template"))
 				}
 			}
 
 			if nodeType == "var" {
-				node := &TreeNode{Type: nodeType, Expression: expression}
+				node := &TreeNode{Type: nodeType, Expression: expression, src: src, pos: tok.pos}
 				current.Children = append(current.Children, node)
 			}
 
-			if nodeType == "if" || nodeType == "for" || nodeType == "block" || nodeType == "elseif" || nodeType == "else" {
-				node := &TreeNode{Type: nodeType, Expression: expression}
+			// A set without assignment captures its content until endset
+			isCapture := nodeType == "set" && !setAssignRegexp.MatchString(expression)
+
+			if nodeType == "if" || nodeType == "for" || nodeType == "block" || nodeType == "elseif" || nodeType == "else" || nodeType == "with" || isCapture {
+				node := &TreeNode{Type: nodeType, Expression: expression, src: src, pos: tok.pos}
 				current.Children = append(current.Children, node)
 				stack = append(stack, current)
 				current = node
 			}
 
-			if nodeType == "extends" || nodeType == "include" {
-				node := &TreeNode{Type: nodeType, Expression: expression}
+			if nodeType == "extends" || nodeType == "include" || nodeType == "break" || nodeType == "continue" || (nodeType == "set" && !isCapture) {
+				node := &TreeNode{Type: nodeType, Expression: expression, src: src, pos: tok.pos}
 				current.Children = append(current.Children, node)
 			}
+			hasContent = true
 		} else {
-			current.Children = append(current.Children, &TreeNode{Type: "lit", Expression: token})
+			current.Children = append(current.Children, &TreeNode{Type: "lit", Expression: token, src: src, pos: tok.pos})
+			if strings.TrimSpace(token) != "" {
+				hasContent = true
+			}
 		}
 	}
 
-	return root
+	// Report blocks that are still open at the end of the template
+	stack = append(stack, current)
+	for _, node := range stack[1:] {
+		tag := node.Type
+		if tag == "forelse" {
+			tag = "else"
+		}
+		errs = append(errs, src.errorAt(node.pos, "unclosed `%s`, expected `%s`", tag, closeTags[node.Type]))
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return root, nil
 }
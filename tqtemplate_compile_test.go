@@ -0,0 +1,204 @@
+package tqtemplate
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Test compiling once and rendering with different data
+func TestCompileRenderMultipleTimes(t *testing.T) {
+	compiled, err := template.Compile("{% for i in items %}{{ i|upper }}{% if i == \"b\" %}!{% endif %}{% endfor %}")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	result, _ := compiled.Render(map[string]any{"items": []any{"a", "b"}})
+	if result != "AB!" {
+		t.Errorf("Expected 'AB!', got '%s'", result)
+	}
+
+	result, _ = compiled.Render(map[string]any{"items": []any{"c"}})
+	if result != "C" {
+		t.Errorf("Expected 'C', got '%s'", result)
+	}
+}
+
+// Test compiling a template file through the loader
+func TestCompileFile(t *testing.T) {
+	loads := 0
+	loader := func(name string) (string, error) {
+		loads++
+		if name == "hello.html" {
+			return "Hello {{ name }}", nil
+		}
+		return "", fmt.Errorf("template not found: %s", name)
+	}
+
+	compiled, err := NewTemplateWithLoader(loader).CompileFile("hello.html")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if compiled.Name() != "hello.html" {
+		t.Errorf("Expected name 'hello.html', got '%s'", compiled.Name())
+	}
+
+	for _, name := range []string{"Alice", "Bob"} {
+		result, _ := compiled.Render(map[string]any{"name": name})
+		if result != "Hello "+name {
+			t.Errorf("Expected 'Hello %s', got '%s'", name, result)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("Expected template to be loaded once, got %d loads", loads)
+	}
+}
+
+// Test that extends and include are resolved at compile time
+func TestCompileResolvesExtendsAndIncludes(t *testing.T) {
+	templates := map[string]string{
+		"base.html":   "<main>{% block content %}{% endblock %}</main>",
+		"header.html": "<h1>{{ title }}</h1>",
+	}
+	loads := 0
+	loader := func(name string) (string, error) {
+		loads++
+		if tmpl, exists := templates[name]; exists {
+			return tmpl, nil
+		}
+		return "", fmt.Errorf("template not found: %s", name)
+	}
+
+	tmpl := NewTemplateWithLoader(loader)
+	compiled, err := tmpl.Compile("{% extends 'base.html' %}{% block content %}{% include 'header.html' %}{% include 'header.html' %}{% endblock %}")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	result, _ := compiled.Render(map[string]any{"title": "One"})
+	if result != "<main><h1>One</h1><h1>One</h1></main>" {
+		t.Errorf("Unexpected result '%s'", result)
+	}
+	result, _ = compiled.Render(map[string]any{"title": "Two"})
+	if result != "<main><h1>Two</h1><h1>Two</h1></main>" {
+		t.Errorf("Unexpected result '%s'", result)
+	}
+	if loads != 2 {
+		t.Errorf("Expected 2 loads, got %d", loads)
+	}
+}
+
+// Test that a missing include only fails when it is rendered
+func TestCompileMissingIncludeInUntakenBranch(t *testing.T) {
+	loader := func(name string) (string, error) {
+		return "", fmt.Errorf("template not found: %s", name)
+	}
+
+	compiled, err := NewTemplateWithLoader(loader).Compile("{% if show %}{% include 'missing.html' %}{% endif %}ok")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	result, err := compiled.Render(map[string]any{"show": false})
+	if err != nil || result != "ok" {
+		t.Errorf("Expected 'ok' without error, got '%s' (%v)", result, err)
+	}
+
+	_, err = compiled.Render(map[string]any{"show": true})
+	if err == nil || !strings.Contains(err.Error(), "failed to load included template") {
+		t.Errorf("Expected include error, got: %v", err)
+	}
+}
+
+// Test that a missing parent template fails at compile time
+func TestCompileExtendsNotFound(t *testing.T) {
+	loader := func(name string) (string, error) {
+		return "", fmt.Errorf("template not found: %s", name)
+	}
+
+	_, err := NewTemplateWithLoader(loader).Compile("{% extends 'nonexistent.html' %}")
+	if err == nil || !strings.Contains(err.Error(), "failed to load parent template") {
+		t.Errorf("Expected parent template error, got: %v", err)
+	}
+}
+
+func BenchmarkRender(b *testing.B) {
+	tmpl := "<ul>{% for item in items %}<li>{{ item.name|upper }}{% if item.price > 10 %} (expensive){% endif %}</li>{% endfor %}</ul>"
+	data := map[string]any{"items": []any{
+		map[string]any{"name": "apple", "price": 5},
+		map[string]any{"name": "melon", "price": 15},
+	}}
+	for i := 0; i < b.N; i++ {
+		template.Render(tmpl, data)
+	}
+}
+
+func BenchmarkCompiledRender(b *testing.B) {
+	compiled, _ := template.Compile("<ul>{% for item in items %}<li>{{ item.name|upper }}{% if item.price > 10 %} (expensive){% endif %}</li>{% endfor %}</ul>")
+	data := map[string]any{"items": []any{
+		map[string]any{"name": "apple", "price": 5},
+		map[string]any{"name": "melon", "price": 15},
+	}}
+	for i := 0; i < b.N; i++ {
+		compiled.Render(data)
+	}
+}
+
+// Test rendering one compiled template from many goroutines (run with -race)
+func TestCompiledRenderConcurrent(t *testing.T) {
+	compiled, err := template.Compile("{% if n is even %}even{% elseif n == 3 %}three{% else %}odd{% endif %}")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			expected := "odd"
+			if n%2 == 0 {
+				expected = "even"
+			} else if n == 3 {
+				expected = "three"
+			}
+			for j := 0; j < 20; j++ {
+				result, _ := compiled.Render(map[string]any{"n": n})
+				if result != expected {
+					t.Errorf("Expected '%s' for %d, got '%s'", expected, n, result)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Test changing the engine settings while a compiled template renders (run with -race)
+func TestCompiledRenderWhileChangingSettings(t *testing.T) {
+	tmpl := NewTemplate()
+	compiled, err := tmpl.Compile("a{{ missing }}b")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			tmpl.SetUndefinedPolicy(UndefinedLenient)
+			tmpl.SetErrorMode(ErrorModeStrict)
+			tmpl.SetWarningHandler(func(*RenderError) {})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		result, err := compiled.Render(map[string]any{})
+		if err != nil || result != "a{{missing!!path `missing` not found}}b" {
+			t.Errorf("Expected the settings at compile time, got '%s' (%v)", result, err)
+			break
+		}
+	}
+	wg.Wait()
+}
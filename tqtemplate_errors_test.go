@@ -0,0 +1,428 @@
+package tqtemplate
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// parseError compiles a template and returns the resulting *TemplateError
+func parseError(t *testing.T, tmpl *Template, src string) *TemplateError {
+	t.Helper()
+	_, err := tmpl.Compile(src)
+	if err == nil {
+		t.Fatalf("Expected error for %q", src)
+	}
+	var templateErr *TemplateError
+	if !errors.As(err, &templateErr) {
+		t.Fatalf("Expected *TemplateError, got %T: %v", err, err)
+	}
+	return templateErr
+}
+
+func TestErrorUnterminatedVariable(t *testing.T) {
+	err := parseError(t, template, "line 1\nhello {{ name")
+	if err.Line != 2 || err.Column != 7 {
+		t.Errorf("Expected 2:7, got %d:%d", err.Line, err.Column)
+	}
+	if err.Error() != "template:2:7: unterminated variable, expected `}}`" {
+		t.Errorf("Unexpected message '%s'", err.Error())
+	}
+	if err.Snippet != "hello {{ name\n      ^" {
+		t.Errorf("Unexpected snippet %q", err.Snippet)
+	}
+}
+
+func TestErrorUnterminatedTag(t *testing.T) {
+	err := parseError(t, template, "{% if a %}x{% endif")
+	if err.Line != 1 || err.Column != 12 {
+		t.Errorf("Expected 1:12, got %d:%d", err.Line, err.Column)
+	}
+}
+
+func TestErrorUnterminatedComment(t *testing.T) {
+	err := parseError(t, template, "a\n\tb {# comment")
+	if err.Line != 2 || err.Column != 4 {
+		t.Errorf("Expected 2:4, got %d:%d", err.Line, err.Column)
+	}
+	if err.Snippet != "\tb {# comment\n\t  ^" {
+		t.Errorf("Unexpected snippet %q", err.Snippet)
+	}
+}
+
+func TestErrorStrayEndTag(t *testing.T) {
+	err := parseError(t, template, "héllo\n  {% endif %}")
+	if err.Line != 2 || err.Column != 3 {
+		t.Errorf("Expected 2:3, got %d:%d", err.Line, err.Column)
+	}
+	if err.Message != "unexpected `endif`, no open block to close" {
+		t.Errorf("Unexpected message '%s'", err.Message)
+	}
+}
+
+func TestErrorInvalidForSyntax(t *testing.T) {
+	err := parseError(t, template, "{% for items %}{% endfor %}")
+	if err.Line != 1 || err.Column != 1 {
+		t.Errorf("Expected 1:1, got %d:%d", err.Line, err.Column)
+	}
+}
+
+func TestErrorTemplateNameFromLoader(t *testing.T) {
+	templates := map[string]string{
+		"page.html":    "{% include 'partial.html' %}",
+		"partial.html": "ok\n{{ broken",
+	}
+	loader := func(name string) (string, error) {
+		if tmpl, exists := templates[name]; exists {
+			return tmpl, nil
+		}
+		return "", fmt.Errorf("template not found: %s", name)
+	}
+
+	_, err := NewTemplateWithLoader(loader).RenderFile("page.html", map[string]any{})
+	var templateErr *TemplateError
+	if !errors.As(err, &templateErr) {
+		t.Fatalf("Expected *TemplateError, got %T: %v", err, err)
+	}
+	if templateErr.Error() != "partial.html:2:1: unterminated variable, expected `}}`" {
+		t.Errorf("Unexpected message '%s'", templateErr.Error())
+	}
+}
+
+// parseErrors compiles a template and returns all resulting errors
+func parseErrors(t *testing.T, src string) TemplateErrors {
+	t.Helper()
+	_, err := template.Compile(src)
+	var errs TemplateErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Expected TemplateErrors, got %T: %v", err, err)
+	}
+	return errs
+}
+
+func TestErrorMismatchedEndTag(t *testing.T) {
+	errs := parseErrors(t, "{% if a %}\n{% endfor %}")
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, got %d: %v", len(errs), errs)
+	}
+	if errs[0].Error() != "template:2:1: unexpected `endfor`, expected `endif`" {
+		t.Errorf("Unexpected message '%s'", errs[0].Error())
+	}
+	if errs[1].Error() != "template:1:1: unclosed `if`, expected `endif`" {
+		t.Errorf("Unexpected message '%s'", errs[1].Error())
+	}
+}
+
+func TestErrorMismatchedEndTagRecovers(t *testing.T) {
+	// The endfor closes the for loop, leaving only the unclosed if reported
+	errs := parseErrors(t, "{% for i in items %}{% if i %}{% endfor %}")
+	if len(errs) != 1 {
+		t.Fatalf("Expected 1 error, got %d: %v", len(errs), errs)
+	}
+	if errs[0].Message != "unexpected `endfor`, expected `endif`" {
+		t.Errorf("Unexpected message '%s'", errs[0].Message)
+	}
+}
+
+func TestErrorUnclosedBlocks(t *testing.T) {
+	errs := parseErrors(t, "{% block content %}\n  {% for i in items %}\n    {% if i %}")
+	if len(errs) != 3 {
+		t.Fatalf("Expected 3 errors, got %d: %v", len(errs), errs)
+	}
+	expected := []string{
+		"template:1:1: unclosed `block`, expected `endblock`",
+		"template:2:3: unclosed `for`, expected `endfor`",
+		"template:3:5: unclosed `if`, expected `endif`",
+	}
+	for i, err := range errs {
+		if err.Error() != expected[i] {
+			t.Errorf("Expected '%s', got '%s'", expected[i], err.Error())
+		}
+	}
+}
+
+func TestErrorElseOutsideIf(t *testing.T) {
+	errs := parseErrors(t, "{% block b %}{% else %}{% endblock %}{% elseif a %}")
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, got %d: %v", len(errs), errs)
+	}
+	if errs[0].Message != "unexpected `else` outside of `if` or `for`" || errs[0].Column != 14 {
+		t.Errorf("Unexpected error '%s'", errs[0].Error())
+	}
+	if errs[1].Message != "unexpected `elseif` outside of `if`" {
+		t.Errorf("Unexpected error '%s'", errs[1].Error())
+	}
+}
+
+func TestErrorDuplicateBlock(t *testing.T) {
+	errs := parseErrors(t, "{% block title %}a{% endblock %}\n{% block title %}b{% endblock %}")
+	if len(errs) != 1 {
+		t.Fatalf("Expected 1 error, got %d: %v", len(errs), errs)
+	}
+	if errs[0].Error() != "template:2:1: duplicate block `title`, already defined on line 1" {
+		t.Errorf("Unexpected message '%s'", errs[0].Error())
+	}
+}
+
+func TestErrorExtendsNotFirst(t *testing.T) {
+	errs := parseErrors(t, "<p>hi</p>\n{% extends 'base.html' %}")
+	if len(errs) != 1 || errs[0].Message != "`extends` must be the first tag in the template" {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+
+	errs = parseErrors(t, "{% block a %}{% extends 'base.html' %}{% endblock %}")
+	if len(errs) != 1 || errs[0].Line != 1 || errs[0].Column != 14 {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+}
+
+func TestErrorsReportedTogether(t *testing.T) {
+	_, err := template.Compile("{% endif %}\n{% block a %}{% endblock %}{% block a %}{% endblock %}\n{% if x %}")
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	expected := "template:1:1: unexpected `endif`, no open block to close\n" +
+		"template:2:28: duplicate block `a`, already defined on line 2\n" +
+		"template:3:1: unclosed `if`, expected `endif`"
+	if err.Error() != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, err.Error())
+	}
+}
+
+func TestErrorModeInline(t *testing.T) {
+	result, err := template.Render("{% for i in missing %}{{ i }}{% endfor %}", map[string]any{})
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if result != "{% for i in missing!!path `missing` not found %}" {
+		t.Errorf("Unexpected result '%s'", result)
+	}
+}
+
+func TestErrorModeStrict(t *testing.T) {
+	tmpl := NewTemplate()
+	tmpl.SetErrorMode(ErrorModeStrict)
+
+	result, err := tmpl.Render("Hello\n  {{ name|failure }}!", map[string]any{"name": "world"})
+	if result != "" {
+		t.Errorf("Expected empty result, got '%s'", result)
+	}
+	var renderErr *RenderError
+	if !errors.As(err, &renderErr) {
+		t.Fatalf("Expected *RenderError, got %T: %v", err, err)
+	}
+	if renderErr.Line != 2 || renderErr.Column != 3 || renderErr.Tag != "var" || renderErr.Expression != "name|failure" {
+		t.Errorf("Unexpected error fields: %+v", renderErr)
+	}
+	if err.Error() != "template:2:3: error in `{{ name|failure }}`: filter `failure` not found" {
+		t.Errorf("Unexpected message '%s'", err.Error())
+	}
+}
+
+func TestErrorModeStrictInIfAndFor(t *testing.T) {
+	tmpl := NewTemplate()
+	tmpl.SetErrorMode(ErrorModeStrict)
+
+	_, err := tmpl.Render("{% if a / 0 %}x{% endif %}", map[string]any{"a": 1})
+	if err == nil || err.Error() != "template:1:1: error in `{% if a / 0 %}`: division by zero" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	_, err = tmpl.Render("{% for i in n %}x{% endfor %}", map[string]any{"n": true})
+	if err == nil || err.Error() != "template:1:1: error in `{% for i in n %}`: expression must evaluate to an array" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestErrorModeStrictCustomDelimiters(t *testing.T) {
+	tmpl := New(Options{ErrorMode: ErrorModeStrict, Delimiters: Delimiters{
+		VariableStart: "<%=", VariableEnd: "%>",
+		BlockStart: "<%", BlockEnd: "%>",
+	}})
+
+	_, err := tmpl.Render("<%= name|failure %>", map[string]any{"name": "world"})
+	if err == nil || err.Error() != "template:1:1: error in `<%= name|failure %>`: filter `failure` not found" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	_, err = tmpl.Render("<% if a / 0 %>x<% endif %>", map[string]any{"a": 1})
+	if err == nil || err.Error() != "template:1:1: error in `<% if a / 0 %>`: division by zero" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestErrorModeLenient(t *testing.T) {
+	var warnings []*RenderError
+	tmpl := NewTemplate()
+	tmpl.SetErrorMode(ErrorModeLenient)
+	tmpl.SetWarningHandler(func(err *RenderError) {
+		warnings = append(warnings, err)
+	})
+
+	result, err := tmpl.Render("a{{ missing }}b{% if x.y %}c{% endif %}d", map[string]any{})
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if result != "abd" {
+		t.Errorf("Expected 'abd', got '%s'", result)
+	}
+	if len(warnings) != 2 {
+		t.Fatalf("Expected 2 warnings, got %d", len(warnings))
+	}
+	if warnings[0].Error() != "template:1:2: error in `{{ missing }}`: path `missing` not found" {
+		t.Errorf("Unexpected warning '%s'", warnings[0].Error())
+	}
+	if warnings[1].Tag != "if" || warnings[1].Column != 16 {
+		t.Errorf("Unexpected warning '%s'", warnings[1].Error())
+	}
+}
+
+func TestErrorUnclosedRaw(t *testing.T) {
+	err := parseError(t, template, "a\n{% raw %}{{ x }}{% endblock %}")
+	if err.Error() != "template:2:1: unclosed `raw`, expected `endraw`" {
+		t.Errorf("Unexpected message '%s'", err.Error())
+	}
+
+	errs := parseErrors(t, "a {% endraw %}")
+	if len(errs) != 1 || errs[0].Error() != "template:1:3: unexpected `endraw` outside of `raw`" {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+}
+
+func TestErrorInvalidSet(t *testing.T) {
+	err := parseError(t, template, "{% set 1x %}{% endset %}")
+	if err.Message != `invalid set syntax, expected "name = expression" or "name"` {
+		t.Errorf("Unexpected message '%s'", err.Message)
+	}
+
+	errs := parseErrors(t, "{% set x %}abc")
+	if len(errs) != 1 || errs[0].Error() != "template:1:1: unclosed `set`, expected `endset`" {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+}
+
+func TestErrorInvalidWith(t *testing.T) {
+	err := parseError(t, template, "{% with a = 1, b %}{% endwith %}")
+	if err.Message != `invalid with syntax, expected "name = expression, ..."` {
+		t.Errorf("Unexpected message '%s'", err.Message)
+	}
+
+	errs := parseErrors(t, "{% with a = 1 %}{% endfor %}")
+	if len(errs) != 2 || errs[0].Message != "unexpected `endfor`, expected `endwith`" {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+}
+
+func TestErrorUnclosedForElse(t *testing.T) {
+	errs := parseErrors(t, "{% for i in items %}x\n{% else %}none{% else %}")
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, got %d: %v", len(errs), errs)
+	}
+	if errs[0].Message != "unexpected `else` outside of `if` or `for`" {
+		t.Errorf("Unexpected error '%s'", errs[0].Error())
+	}
+	if errs[1].Error() != "template:2:1: unclosed `else`, expected `endfor`" {
+		t.Errorf("Unexpected error '%s'", errs[1].Error())
+	}
+}
+
+func TestErrorBreakOutsideLoop(t *testing.T) {
+	errs := parseErrors(t, "{% if a %}{% break %}{% endif %}{% for i in items %}{% else %}{% continue if i %}{% endfor %}")
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, got %d: %v", len(errs), errs)
+	}
+	if errs[0].Error() != "template:1:11: unexpected `break` outside of `for`" {
+		t.Errorf("Unexpected error '%s'", errs[0].Error())
+	}
+	if errs[1].Message != "unexpected `continue` outside of `for`" {
+		t.Errorf("Unexpected error '%s'", errs[1].Error())
+	}
+}
+
+func TestErrorUnknownTag(t *testing.T) {
+	errs := parseErrors(t, "{% if a %}x{% endfi %}\n{% elseif %}{% endif %}")
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, got %d: %v", len(errs), errs)
+	}
+	if errs[0].Error() != "template:1:12: unknown tag `endfi`" {
+		t.Errorf("Unexpected error '%s'", errs[0].Error())
+	}
+	if errs[1].Error() != "template:2:1: missing expression in `elseif`" {
+		t.Errorf("Unexpected error '%s'", errs[1].Error())
+	}
+}
+
+func TestErrorEmptyTag(t *testing.T) {
+	errs := parseErrors(t, "a{% %}{% include %}")
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, got %d: %v", len(errs), errs)
+	}
+	if errs[0].Error() != "template:1:2: empty tag" {
+		t.Errorf("Unexpected error '%s'", errs[0].Error())
+	}
+	if errs[1].Message != "missing expression in `include`" {
+		t.Errorf("Unexpected error '%s'", errs[1].Error())
+	}
+}
+
+func TestErrorModeStrictInclude(t *testing.T) {
+	tmpl := New(Options{
+		Loader: func(name string) (string, error) {
+			if name == "self.html" {
+				return "x{% include 'self.html' %}", nil
+			}
+			return "", fmt.Errorf("template not found: %s", name)
+		},
+		ErrorMode:       ErrorModeStrict,
+		MaxIncludeDepth: 2,
+	})
+
+	_, err := tmpl.Render("a\n {% include 'missing.html' %}", map[string]any{})
+	var renderErr *RenderError
+	if !errors.As(err, &renderErr) {
+		t.Fatalf("Expected *RenderError, got %T: %v", err, err)
+	}
+	if renderErr.Line != 2 || renderErr.Column != 2 || renderErr.Tag != "include" {
+		t.Errorf("Unexpected error fields: %+v", renderErr)
+	}
+
+	_, err = tmpl.Render("{% include 'self.html' %}", map[string]any{})
+	if !errors.As(err, &renderErr) || renderErr.Name != "self.html" {
+		t.Fatalf("Expected *RenderError in self.html, got %T: %v", err, err)
+	}
+	if err.Error() != "self.html:1:2: error in `{% include 'self.html' %}`: maximum include depth of 2 exceeded" {
+		t.Errorf("Unexpected message '%s'", err.Error())
+	}
+}
+
+func TestErrorModeInlineInclude(t *testing.T) {
+	tmpl := New(Options{
+		Loader: func(name string) (string, error) { return "", fmt.Errorf("template not found: %s", name) },
+	})
+
+	result, err := tmpl.Render("a{% include 'missing.html' %}b", map[string]any{})
+	if err == nil || err.Error() != "failed to load included template 'missing.html': template not found: missing.html" {
+		t.Errorf("Expected load error, got '%s' (%v)", result, err)
+	}
+	var renderErr *RenderError
+	if errors.As(err, &renderErr) {
+		t.Errorf("Expected the load error as is, got %T", err)
+	}
+}
+
+func TestErrorModeLenientInclude(t *testing.T) {
+	var warnings []*RenderError
+	tmpl := New(Options{
+		Loader:         func(name string) (string, error) { return "", fmt.Errorf("template not found: %s", name) },
+		ErrorMode:      ErrorModeLenient,
+		WarningHandler: func(err *RenderError) { warnings = append(warnings, err) },
+	})
+
+	result, err := tmpl.Render("a{% include 'missing.html' %}b", map[string]any{})
+	if err != nil || result != "ab" {
+		t.Errorf("Expected 'ab', got '%s' (%v)", result, err)
+	}
+	if len(warnings) != 1 || warnings[0].Tag != "include" {
+		t.Errorf("Unexpected warnings: %v", warnings)
+	}
+}
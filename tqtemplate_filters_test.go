@@ -340,6 +340,73 @@ func TestFilterSumAttribute(t *testing.T) {
 	}
 }
 
+func TestFilterDictSort(t *testing.T) {
+	result, _ := template.Render("{% for k, v in scores|dictsort %}{{ k }} {% endfor %}", map[string]any{"scores": map[string]any{"bob": 7, "ann": 9, "cid": 7, "dan": 10}})
+	expected := "ann bob cid dan "
+	if result != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, result)
+	}
+}
+
+func TestFilterDictSortReverse(t *testing.T) {
+	result, _ := template.Render(`{% for k, v in scores|dictsort("key", 1) %}{{ k }} {% endfor %}`, map[string]any{"scores": map[string]any{"bob": 7, "ann": 9, "cid": 7, "dan": 10}})
+	expected := "dan cid bob ann "
+	if result != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, result)
+	}
+}
+
+func TestFilterDictSortByValue(t *testing.T) {
+	result, _ := template.Render(`{% for k, v in scores|dictsort("value") %}{{ k }}={{ v }} {% endfor %}`, map[string]any{"scores": map[string]any{"bob": 7, "ann": 9, "cid": 7, "dan": 10}})
+	expected := "bob=7 cid=7 ann=9 dan=10 "
+	if result != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, result)
+	}
+}
+
+func TestFilterDictSortByValueReverse(t *testing.T) {
+	result, _ := template.Render(`{% for k, v in scores|dictsort("value", 1) %}{{ k }} {% endfor %}`, map[string]any{"scores": map[string]any{"bob": 7, "ann": 9, "cid": 7, "dan": 10}})
+	expected := "dan ann cid bob "
+	if result != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, result)
+	}
+}
+
+func TestFilterDictSortInvalidOrder(t *testing.T) {
+	result, _ := template.Render("{{ scores|dictsort(by) }}", map[string]any{"scores": map[string]any{"bob": 7}, "by": "size"})
+	expected := "{{scores|dictsort(by)!!filter `dictsort`: can only sort by `key` or `value`, not `size`}}"
+	if result != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, result)
+	}
+}
+
+func TestFilterDictSortMixedKeys(t *testing.T) {
+	data := map[string]any{"m": map[string]any{"10": 1, "9": 2, "1a": 3, "b": 4}}
+	expected := "9 10 1a b "
+	for range 100 {
+		result, _ := template.Render("{% for k, v in m|dictsort %}{{ k }} {% endfor %}", data)
+		if result != expected {
+			t.Fatalf("Expected '%s', got '%s'", expected, result)
+		}
+	}
+}
+
+func TestFilterDictSortTypedMap(t *testing.T) {
+	result, _ := template.Render(`{% for k, v in m|dictsort("value", true) %}{{ k }}{% endfor %}`, map[string]any{"m": map[string]int{"a": 1, "b": 3, "c": 2}})
+	expected := "bca"
+	if result != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, result)
+	}
+}
+
+func TestFilterDictSortInvalidValue(t *testing.T) {
+	result, _ := template.Render("{{ m|dictsort }}", map[string]any{"m": map[int]string{1: "a"}})
+	expected := "{{m|dictsort!!filter `dictsort`: can only sort a map with string keys, not map[int]string}}"
+	if result != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, result)
+	}
+}
+
 // Utility filter tests
 
 func TestFilterDefault(t *testing.T) {
@@ -1,6 +1,10 @@
 package tqtemplate
 
 import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -381,6 +385,13 @@ func TestExpressionLogicalOrWordBased(t *testing.T) {
 	}
 }
 
+func TestExpressionIdentifierStartingWithOperator(t *testing.T) {
+	result, _ := template.Render("{{ order.total + orbit }}", map[string]any{"order": map[string]any{"total": 1}, "orbit": 2})
+	if result != "3" {
+		t.Errorf("Expected '3', got '%s'", result)
+	}
+}
+
 func TestExpressionLogicalMixedWordAndSymbol(t *testing.T) {
 	result, _ := template.Render("{% if a > 5 and b < 20 or c == 10 %}yes{% endif %}", map[string]any{"a": 10, "b": 15, "c": 0})
 	if result != "yes" {
@@ -1476,6 +1487,28 @@ func TestCustomTestWithArgument(t *testing.T) {
 	}
 }
 
+func TestUnknownTest(t *testing.T) {
+	result, _ := template.Render("{% if x is foo %}yes{% endif %}", map[string]any{"x": 1})
+	if result != "{% if x is foo!!test `foo` not found %}" {
+		t.Errorf("Expected '{%% if x is foo!!test `foo` not found %%}', got '%s'", result)
+	}
+}
+
+func TestUnknownTestNegated(t *testing.T) {
+	result, _ := template.Render("{{ x is not foo }}", map[string]any{"x": 1})
+	if result != "{{x is not foo!!test `foo` not found}}" {
+		t.Errorf("Expected '{{x is not foo!!test `foo` not found}}', got '%s'", result)
+	}
+}
+
+func TestCustomTestMissingArgument(t *testing.T) {
+	tmpl := New(Options{Tests: map[string]any{"above": func(value, min int) bool { return value > min }}})
+	result, _ := tmpl.Render("{% if x is above %}yes{% endif %}", map[string]any{"x": 1})
+	if result != "{% if x is above!!test `above`: expected 2 arguments, got 1 %}" {
+		t.Errorf("Expected '{%% if x is above!!test `above`: expected 2 arguments, got 1 %%}', got '%s'", result)
+	}
+}
+
 func TestCustomTestWithNot(t *testing.T) {
 	tests := map[string]any{
 		"empty": func(value any) bool {
@@ -1595,3 +1628,1872 @@ func TestCustomTestsWithCustomFilters(t *testing.T) {
 		t.Errorf("Expected 'no' (3*2=6 is not large), got '%s'", result)
 	}
 }
+
+// Tests for streaming output to an io.Writer
+
+func TestRenderTo(t *testing.T) {
+	var sb strings.Builder
+	err := template.RenderTo(&sb, "<ul>{% for i in items %}<li>{{ i }}</li>{% endfor %}</ul>", map[string]any{"items": []any{"<a>", "b"}})
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if sb.String() != "<ul><li>&lt;a&gt;</li><li>b</li></ul>" {
+		t.Errorf("Expected '<ul><li>&lt;a&gt;</li><li>b</li></ul>', got '%s'", sb.String())
+	}
+}
+
+func TestRenderFileTo(t *testing.T) {
+	loader := func(name string) (string, error) {
+		return "Hello {{ name }}", nil
+	}
+	var sb strings.Builder
+	err := NewTemplateWithLoader(loader).RenderFileTo(&sb, "hello.html", map[string]any{"name": "World"})
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if sb.String() != "Hello World" {
+		t.Errorf("Expected 'Hello World', got '%s'", sb.String())
+	}
+}
+
+type failingWriter struct {
+	written int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.written > 0 {
+		return 0, errors.New("write failed")
+	}
+	w.written += len(p)
+	return len(p), nil
+}
+
+func TestRenderToWriterError(t *testing.T) {
+	w := &failingWriter{}
+	err := template.RenderTo(w, "{% for i in items %}{{ i }}{% endfor %}", map[string]any{"items": []any{1, 2, 3}})
+	if err == nil || err.Error() != "write failed" {
+		t.Errorf("Expected 'write failed' error, got: %v", err)
+	}
+}
+
+// Tests for undefined policies
+
+func TestUndefinedStrict(t *testing.T) {
+	result, _ := template.Render("{{ missing }}", map[string]any{})
+	if result != "{{missing!!path `missing` not found}}" {
+		t.Errorf("Unexpected result '%s'", result)
+	}
+
+	result, _ = template.Render("{% if missing > 1 %}yes{% endif %}", map[string]any{})
+	if result != "{% if missing &gt; 1!!path `missing` not found %}" {
+		t.Errorf("Unexpected result '%s'", result)
+	}
+
+	// Tests and the default filter accept undefined values, also when chained
+	result, _ = template.Render("{% if a.b.c is defined %}yes{% else %}no{% endif %} {{ a.b|default(\"none\") }}", map[string]any{})
+	if result != "no none" {
+		t.Errorf("Expected 'no none', got '%s'", result)
+	}
+}
+
+func TestUndefinedLenient(t *testing.T) {
+	tmpl := NewTemplate()
+	tmpl.SetUndefinedPolicy(UndefinedLenient)
+
+	tpl := "[{{ missing }}][{{ missing|upper }}][{% if not missing %}empty{% endif %}][{% for i in missing %}{{ i }}{% endfor %}][{{ name|replace(\"a\", missing) }}]"
+	result, _ := tmpl.Render(tpl, map[string]any{"name": "ab"})
+	if result != "[][][empty][][b]" {
+		t.Errorf("Expected '[][][empty][][b]', got '%s'", result)
+	}
+
+	// Accessing an attribute of an undefined value is an error
+	result, _ = tmpl.Render("{{ a.b }}", map[string]any{})
+	if result != "{{a.b!!path `a` not found}}" {
+		t.Errorf("Unexpected result '%s'", result)
+	}
+
+	// An attribute that does not exist on a defined value is undefined
+	result, _ = tmpl.Render("[{{ a.b }}]", map[string]any{"a": map[string]any{}})
+	if result != "[]" {
+		t.Errorf("Expected '[]', got '%s'", result)
+	}
+}
+
+func TestUndefinedChainable(t *testing.T) {
+	tmpl := NewTemplate()
+	tmpl.SetUndefinedPolicy(UndefinedChainable)
+
+	result, _ := tmpl.Render("[{{ a.b.c }}][{% if a.b.c is undefined %}undefined{% endif %}]", map[string]any{})
+	if result != "[][undefined]" {
+		t.Errorf("Expected '[][undefined]', got '%s'", result)
+	}
+}
+
+func TestUndefinedDebug(t *testing.T) {
+	tmpl := NewTemplate()
+	tmpl.SetUndefinedPolicy(UndefinedDebug)
+
+	result, _ := tmpl.Render("Hello {{ user.name }}, {{ missing }}!", map[string]any{"user": map[string]any{}})
+	if result != "Hello {{ user.name }}, {{ missing }}!" {
+		t.Errorf("Unexpected result '%s'", result)
+	}
+}
+
+// Tests for engine options
+
+func TestNewWithOptions(t *testing.T) {
+	tmpl := New(Options{
+		Loader:  func(name string) (string, error) { return "{{ greeting|shout }} {{ name }}", nil },
+		Filters: map[string]any{"shout": func(s string) string { return strings.ToUpper(s) + "!" }},
+		Globals: map[string]any{"greeting": "hello", "name": "global"},
+	})
+	result, err := tmpl.RenderFile("page.html", map[string]any{"name": "World"})
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if result != "HELLO! World" {
+		t.Errorf("Expected 'HELLO! World', got '%s'", result)
+	}
+}
+
+func TestNewWithEscapeNone(t *testing.T) {
+	tmpl := New(Options{Escape: EscapeNone})
+	result, _ := tmpl.Render("Dear {{ name }},", map[string]any{"name": "Tom & Jerry <tj@example.com>"})
+	if result != "Dear Tom & Jerry <tj@example.com>," {
+		t.Errorf("Unexpected result '%s'", result)
+	}
+}
+
+func TestNewWithUndefinedAndErrorMode(t *testing.T) {
+	tmpl := New(Options{Undefined: UndefinedDebug, ErrorMode: ErrorModeStrict})
+	result, err := tmpl.Render("{{ missing }}", map[string]any{})
+	if err != nil || result != "{{ missing }}" {
+		t.Errorf("Expected '{{ missing }}', got '%s' (%v)", result, err)
+	}
+}
+
+func TestNewWithMaxIncludeDepth(t *testing.T) {
+	tmpl := New(Options{
+		Loader:          func(name string) (string, error) { return "x{% include 'self.html' %}", nil },
+		MaxIncludeDepth: 3,
+	})
+	_, err := tmpl.RenderFile("self.html", map[string]any{})
+	if err == nil || err.Error() != "maximum include depth of 3 exceeded" {
+		t.Errorf("Expected include depth error, got: %v", err)
+	}
+}
+
+func TestNewWithMaxOutputSize(t *testing.T) {
+	tmpl := New(Options{MaxOutputSize: 5})
+	result, err := tmpl.Render("{% for i in items %}{{ i }}{% endfor %}", map[string]any{"items": []any{1, 2, 3}})
+	if err != nil || result != "123" {
+		t.Errorf("Expected '123', got '%s' (%v)", result, err)
+	}
+	_, err = tmpl.Render("{% for i in items %}{{ i }}{% endfor %}", map[string]any{"items": []any{1, 2, 3, 4, 5, 6}})
+	if err == nil || err.Error() != "output exceeds maximum size of 5 bytes" {
+		t.Errorf("Expected output size error, got: %v", err)
+	}
+}
+
+func TestAddFilter(t *testing.T) {
+	tmpl := NewTemplate()
+	if err := tmpl.AddFilter("shout", func(s string) string { return s + "!" }); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	result, err := tmpl.Render("{{ name|shout }}", map[string]any{"name": "hi"})
+	if err != nil || result != "hi!" {
+		t.Errorf("Expected 'hi!', got '%s' (%v)", result, err)
+	}
+
+	err = tmpl.AddFilter("bad", func(s string) {})
+	if err == nil || err.Error() != "filter `bad`: function must return a value and an optional error" {
+		t.Errorf("Expected signature error, got: %v", err)
+	}
+	if _, exists := tmpl.Filter("bad"); exists {
+		t.Error("Expected invalid filter not to be registered")
+	}
+}
+
+func TestRemoveFilterRestoresBuiltin(t *testing.T) {
+	tmpl := NewTemplate()
+	tmpl.AddFilter("upper", func(s string) string { return "custom" })
+	result, _ := tmpl.Render("{{ name|upper }}", map[string]any{"name": "a"})
+	if result != "custom" {
+		t.Errorf("Expected 'custom', got '%s'", result)
+	}
+	tmpl.RemoveFilter("upper")
+	result, _ = tmpl.Render("{{ name|upper }}", map[string]any{"name": "a"})
+	if result != "A" {
+		t.Errorf("Expected 'A', got '%s'", result)
+	}
+	if _, exists := tmpl.Filter("upper"); !exists {
+		t.Error("Expected builtin filter to be found")
+	}
+}
+
+func TestAddFilterAfterCompile(t *testing.T) {
+	tmpl := NewTemplate()
+	compiled, _ := tmpl.Compile("{{ name|late }}")
+	tmpl.AddFilter("late", func(s string) string { return "late" })
+	result, _ := compiled.Render(map[string]any{"name": "a"})
+	if result != "{{name|late!!filter `late` not found}}" {
+		t.Errorf("Unexpected result '%s'", result)
+	}
+}
+
+func TestAddTest(t *testing.T) {
+	tmpl := NewTemplate()
+	if err := tmpl.AddTest("adult", func(v any) bool { n, _ := toNumber(v); return n >= 18 }); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	result, _ := tmpl.Render("{% if age is adult %}yes{% endif %}", map[string]any{"age": 20})
+	if result != "yes" {
+		t.Errorf("Expected 'yes', got '%s'", result)
+	}
+	if err := tmpl.AddTest("bad", func(v any) string { return "" }); err == nil {
+		t.Error("Expected signature error")
+	}
+	tmpl.RemoveTest("adult")
+	if _, exists := tmpl.Test("adult"); exists {
+		t.Error("Expected test to be removed")
+	}
+	if _, exists := tmpl.Test("even"); !exists {
+		t.Error("Expected builtin test to be found")
+	}
+}
+
+func TestAddGlobal(t *testing.T) {
+	options := Options{Globals: map[string]any{"site": "Example"}}
+	tmpl := New(options)
+	tmpl.AddGlobal("year", 2024)
+	if _, exists := options.Globals["year"]; exists {
+		t.Error("Expected options map not to be modified")
+	}
+	result, _ := tmpl.Render("{{ site }} {{ year }}", map[string]any{"year": 2025})
+	if result != "Example 2025" {
+		t.Errorf("Expected 'Example 2025', got '%s'", result)
+	}
+	tmpl.RemoveGlobal("site")
+	if _, exists := tmpl.Global("site"); exists {
+		t.Error("Expected global to be removed")
+	}
+	if value, _ := tmpl.Global("year"); value != 2024 {
+		t.Errorf("Expected 2024, got %v", value)
+	}
+}
+
+func TestFilterSignatureConvertsArguments(t *testing.T) {
+	tmpl := NewTemplate()
+	tmpl.AddFilter("repeat", func(s string, n int) string { return strings.Repeat(s, n) })
+	result, _ := tmpl.Render("{{ name|repeat(3) }}", map[string]any{"name": "ab"})
+	if result != "ababab" {
+		t.Errorf("Expected 'ababab', got '%s'", result)
+	}
+	result, _ = tmpl.Render(`{{ name|repeat("2") }}`, map[string]any{"name": "ab"})
+	if result != "abab" {
+		t.Errorf("Expected 'abab', got '%s'", result)
+	}
+}
+
+func TestFilterSignatureTimeValue(t *testing.T) {
+	tmpl := NewTemplate()
+	tmpl.AddFilter("date", func(d time.Time, layout string) string { return d.Format(layout) })
+	result, _ := tmpl.Render(`{{ when|date("2006-01-02") }}`, map[string]any{"when": time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC)})
+	if result != "2024-05-13" {
+		t.Errorf("Expected '2024-05-13', got '%s'", result)
+	}
+}
+
+func TestFilterSignatureSlice(t *testing.T) {
+	tmpl := NewTemplate()
+	tmpl.AddFilter("total", func(items []float64) float32 {
+		var sum float32
+		for _, item := range items {
+			sum += float32(item)
+		}
+		return sum
+	})
+	result, _ := tmpl.Render("{{ prices|total }}", map[string]any{"prices": []any{1, 2.5, "3"}})
+	if result != "6.5" {
+		t.Errorf("Expected '6.5', got '%s'", result)
+	}
+	result, _ = tmpl.Render("{{ prices|total|round }}", map[string]any{"prices": []any{1, 2.5, "3"}})
+	if result != "7" {
+		t.Errorf("Expected '7', got '%s'", result)
+	}
+}
+
+func TestFilterSignatureVariadic(t *testing.T) {
+	tmpl := NewTemplate()
+	tmpl.AddFilter("keys", func(m map[string]string, sep string, extra ...string) string {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return strings.Join(append(keys, extra...), sep)
+	})
+	result, _ := tmpl.Render(`{{ labels|keys(",") }}`, map[string]any{"labels": map[string]any{"b": 1, "a": 2}})
+	if result != "a,b" {
+		t.Errorf("Expected 'a,b', got '%s'", result)
+	}
+	result, _ = tmpl.Render(`{{ labels|keys(",", "c", "d") }}`, map[string]any{"labels": map[string]any{"b": 1, "a": 2}})
+	if result != "a,b,c,d" {
+		t.Errorf("Expected 'a,b,c,d', got '%s'", result)
+	}
+}
+
+func TestFilterSignatureArgumentErrors(t *testing.T) {
+	tmpl := NewTemplate()
+	tmpl.AddFilter("repeat", func(s string, n int) string { return strings.Repeat(s, n) })
+	result, _ := tmpl.Render("{{ name|repeat }}", map[string]any{"name": "ab"})
+	if result != "{{name|repeat!!filter `repeat`: expected 2 arguments, got 1}}" {
+		t.Errorf("Expected '{{name|repeat!!filter `repeat`: expected 2 arguments, got 1}}', got '%s'", result)
+	}
+	result, _ = tmpl.Render(`{{ name|repeat("x") }}`, map[string]any{"name": "ab"})
+	if result != "{{name|repeat(&#34;x&#34;)!!filter `repeat`: argument 2: cannot convert string to int}}" {
+		t.Errorf("Expected '{{name|repeat(&#34;x&#34;)!!filter `repeat`: argument 2: cannot convert string to int}}', got '%s'", result)
+	}
+}
+
+func TestFilterSignatureInvalidValue(t *testing.T) {
+	tmpl := NewTemplate()
+	tmpl.AddFilter("date", func(d time.Time, layout string) string { return d.Format(layout) })
+	result, _ := tmpl.Render(`{{ name|date("2006") }}`, map[string]any{"name": "ab"})
+	if result != "{{name|date(&#34;2006&#34;)!!filter `date`: argument 1: cannot convert string to time.Time}}" {
+		t.Errorf("Expected '{{name|date(&#34;2006&#34;)!!filter `date`: argument 1: cannot convert string to time.Time}}', got '%s'", result)
+	}
+}
+
+func TestFilterErrorReturn(t *testing.T) {
+	tmpl := NewTemplate()
+	tmpl.SetErrorMode(ErrorModeStrict)
+	tmpl.AddFilter("positive", func(n int) (int, error) {
+		if n < 0 {
+			return 0, fmt.Errorf("negative number %d", n)
+		}
+		return n, nil
+	})
+	result, err := tmpl.Render("{{ n|positive }}", map[string]any{"n": 3})
+	if err != nil || result != "3" {
+		t.Errorf("Expected '3', got '%s' (%v)", result, err)
+	}
+	_, err = tmpl.Render("{{ n|positive }}", map[string]any{"n": -3})
+	if err == nil || err.Error() != "template:1:1: error in `{{ n|positive }}`: filter `positive`: negative number -3" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestTestArbitrarySignature(t *testing.T) {
+	tmpl := NewTemplate()
+	tmpl.AddTest("longer", func(s string, n int) bool { return len(s) > n })
+	tmpl.AddTest("valid", func(s string) (bool, error) {
+		if s == "" {
+			return false, fmt.Errorf("empty value")
+		}
+		return s == "ok", nil
+	})
+	result, _ := tmpl.Render(`{% if name is longer(2) %}long{% endif %}{% if name is not valid %} invalid{% endif %}`, map[string]any{"name": "abc"})
+	if result != "long invalid" {
+		t.Errorf("Expected 'long invalid', got '%s'", result)
+	}
+	result, _ = tmpl.Render(`{{ name is valid }}`, map[string]any{"name": ""})
+	if result != "{{name is valid!!test `valid`: empty value}}" {
+		t.Errorf("Unexpected result '%s'", result)
+	}
+}
+
+func TestWhitespaceControlControlTags(t *testing.T) {
+	tmpl := "<ul>\n  {%- for i in items -%}\n    <li>{{ i }}</li>\n  {%- endfor -%}\n</ul>"
+	expected := "<ul><li>1</li><li>2</li></ul>"
+	result, _ := template.Render(tmpl, map[string]any{"items": []any{1, 2}})
+	if result != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, result)
+	}
+}
+
+func TestWhitespaceControlVariables(t *testing.T) {
+	tmpl := "Hello\n   {{- name -}}  \n!"
+	expected := "HelloWorld!"
+	result, _ := template.Render(tmpl, map[string]any{"name": "World"})
+	if result != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, result)
+	}
+
+	// A minus that is not next to the delimiter is a subtraction
+	result, _ = template.Render("a {{ n - 1 }} b", map[string]any{"n": 5})
+	if result != "a 4 b" {
+		t.Errorf("Expected 'a 4 b', got '%s'", result)
+	}
+}
+
+func TestWhitespaceControlComments(t *testing.T) {
+	tmpl := "a  {#- comment -#}\n\n  b {#- comment #} c"
+	expected := "ab c"
+	result, _ := template.Render(tmpl, map[string]any{})
+	if result != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, result)
+	}
+}
+
+func TestWhitespaceControlInlineTags(t *testing.T) {
+	tmpl := "<p>\n  {%- if show %} yes {% endif -%}\n</p>"
+	expected := "<p> yes </p>"
+	result, _ := template.Render(tmpl, map[string]any{"show": true})
+	if result != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, result)
+	}
+}
+
+func TestWhitespaceControlPlusKeepsIndentBefore(t *testing.T) {
+	result, _ := template.Render("a\n  {%+ if show %}\nb\n{% endif %}\n", map[string]any{"show": true})
+	if result != "a\n  b\n" {
+		t.Errorf("Expected %q, got %q", "a\n  b\n", result)
+	}
+}
+
+func TestWhitespaceControlPlusKeepsNewlineAfter(t *testing.T) {
+	result, _ := template.Render("a\n  {% if show +%}\nb\n{% endif %}\n", map[string]any{"show": true})
+	if result != "a\n\nb\n" {
+		t.Errorf("Expected %q, got %q", "a\n\nb\n", result)
+	}
+}
+
+func TestWhitespaceControlPlusKeepsStandaloneLine(t *testing.T) {
+	result, _ := template.Render("a\n  {%+ if show +%}\nb\n{% endif %}\n", map[string]any{"show": true})
+	if result != "a\n  \nb\n" {
+		t.Errorf("Expected %q, got %q", "a\n  \nb\n", result)
+	}
+}
+
+func TestWhitespaceControlPlusKeepsStandaloneComment(t *testing.T) {
+	result, _ := template.Render("a\n  {#+ comment +#}\nb", map[string]any{"show": true})
+	if result != "a\n  \nb" {
+		t.Errorf("Expected %q, got %q", "a\n  \nb", result)
+	}
+}
+
+func TestStandaloneCommentRemoved(t *testing.T) {
+	result, _ := template.Render("a\n  {# comment #}\nb", map[string]any{"show": true})
+	if result != "a\nb" {
+		t.Errorf("Expected %q, got %q", "a\nb", result)
+	}
+}
+
+func TestWhitespaceOptionsDefault(t *testing.T) {
+	tmpl := "<ul>\n  {% for i in items %}\n  <li>{{ i }}</li>\n  {% endfor %}\n</ul>\n  {# comment #}\nend"
+	result, _ := New(Options{}).Render(tmpl, map[string]any{"items": []any{1}})
+	if result != "<ul>\n  <li>1</li>\n</ul>\nend" {
+		t.Errorf("Expected %q, got %q", "<ul>\n  <li>1</li>\n</ul>\nend", result)
+	}
+}
+
+func TestWhitespaceOptionsKeepTagIndent(t *testing.T) {
+	tmpl := "<ul>\n  {% for i in items %}\n  <li>{{ i }}</li>\n  {% endfor %}\n</ul>\n  {# comment #}\nend"
+	result, _ := New(Options{KeepTagIndent: true}).Render(tmpl, map[string]any{"items": []any{1}})
+	if result != "<ul>\n    <li>1</li>\n  </ul>\n  end" {
+		t.Errorf("Expected %q, got %q", "<ul>\n    <li>1</li>\n  </ul>\n  end", result)
+	}
+}
+
+func TestWhitespaceOptionsKeepTagNewline(t *testing.T) {
+	tmpl := "<ul>\n  {% for i in items %}\n  <li>{{ i }}</li>\n  {% endfor %}\n</ul>\n  {# comment #}\nend"
+	result, _ := New(Options{KeepTagNewline: true}).Render(tmpl, map[string]any{"items": []any{1}})
+	if result != "<ul>\n\n  <li>1</li>\n\n</ul>\nend" {
+		t.Errorf("Expected %q, got %q", "<ul>\n\n  <li>1</li>\n\n</ul>\nend", result)
+	}
+}
+
+func TestWhitespaceOptionsKeepCommentNewline(t *testing.T) {
+	tmpl := "<ul>\n  {% for i in items %}\n  <li>{{ i }}</li>\n  {% endfor %}\n</ul>\n  {# comment #}\nend"
+	result, _ := New(Options{KeepCommentNewline: true}).Render(tmpl, map[string]any{"items": []any{1}})
+	if result != "<ul>\n  <li>1</li>\n</ul>\n\nend" {
+		t.Errorf("Expected %q, got %q", "<ul>\n  <li>1</li>\n</ul>\n\nend", result)
+	}
+}
+
+func TestWhitespaceOptionsKeepAll(t *testing.T) {
+	tmpl := "<ul>\n  {% for i in items %}\n  <li>{{ i }}</li>\n  {% endfor %}\n</ul>\n  {# comment #}\nend"
+	result, _ := New(Options{KeepTagIndent: true, KeepTagNewline: true, KeepCommentNewline: true}).Render(tmpl, map[string]any{"items": []any{1}})
+	if result != "<ul>\n  \n  <li>1</li>\n  \n</ul>\n  \nend" {
+		t.Errorf("Expected %q, got %q", "<ul>\n  \n  <li>1</li>\n  \n</ul>\n  \nend", result)
+	}
+}
+
+func TestWhitespaceOptionsWithModifiers(t *testing.T) {
+	tmpl := New(Options{KeepTagIndent: true, KeepTagNewline: true})
+	result, _ := tmpl.Render("a\n  {%- if show -%}\n  b\n{% endif %}", map[string]any{"show": true})
+	if result != "ab\n" {
+		t.Errorf("Expected %q, got %q", "ab\n", result)
+	}
+}
+
+func TestRawBlock(t *testing.T) {
+	tmpl := "<div id=\"app\">\n  {% raw %}\n  <p v-if=\"ok\">{{ message }}</p>\n  {% if \"}\" %}{# x #}{% endif %}\n  {% endraw %}\n  <p>{{ message }}</p>\n</div>"
+	expected := "<div id=\"app\">\n  <p v-if=\"ok\">{{ message }}</p>\n  {% if \"}\" %}{# x #}{% endif %}\n  <p>Hello</p>\n</div>"
+	result, err := template.Render(tmpl, map[string]any{"message": "Hello"})
+	if err != nil || result != expected {
+		t.Errorf("Expected %q, got %q (%v)", expected, result, err)
+	}
+}
+
+func TestRawBlockInline(t *testing.T) {
+	result, err := template.Render("a {% raw %}{{ x }}{% endraw %} b", map[string]any{"show": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "a {{ x }} b" {
+		t.Errorf("Expected 'a {{ x }} b', got '%s'", result)
+	}
+}
+
+func TestRawBlockWhitespaceControl(t *testing.T) {
+	result, err := template.Render("a {% raw -%} {{ x }} {%- endraw %} b", map[string]any{"show": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "a {{ x }} b" {
+		t.Errorf("Expected 'a {{ x }} b', got '%s'", result)
+	}
+}
+
+func TestRawBlockContainingRaw(t *testing.T) {
+	result, err := template.Render("{% raw %}{% raw %}{% endraw %}", map[string]any{"show": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "{% raw %}" {
+		t.Errorf("Expected '{%% raw %%}', got '%s'", result)
+	}
+}
+
+func TestRawBlockInIf(t *testing.T) {
+	result, err := template.Render("{% if show %}{% raw %}{{ x }}{% endraw %}{% endif %}", map[string]any{"show": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "{{ x }}" {
+		t.Errorf("Expected '{{ x }}', got '%s'", result)
+	}
+}
+
+func TestCustomDelimiters(t *testing.T) {
+	tmpl := New(Options{Delimiters: Delimiters{
+		VariableStart: "<%=", VariableEnd: "%>",
+		BlockStart: "<%", BlockEnd: "%>",
+		CommentStart: "<%#", CommentEnd: "%>",
+	}})
+	src := "<ul>\n  <% for i in items %>\n  <li><%= i %> {{ i }}</li>\n  <%# comment %>\n  <% endfor %>\n</ul>"
+	expected := "<ul>\n  <li>1 {{ i }}</li>\n  <li>2 {{ i }}</li>\n</ul>"
+	result, err := tmpl.Render(src, map[string]any{"items": []any{1, 2}})
+	if err != nil || result != expected {
+		t.Errorf("Expected %q, got %q (%v)", expected, result, err)
+	}
+}
+
+func TestCustomDelimitersPartial(t *testing.T) {
+	tmpl := New(Options{Delimiters: Delimiters{VariableStart: "[[", VariableEnd: "]]"}})
+	result, err := tmpl.Render("\\section{[[ title ]]}", map[string]any{"title": "Intro"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "\\section{Intro}" {
+		t.Errorf("Expected '\\section{Intro}', got '%s'", result)
+	}
+}
+
+func TestCustomDelimitersPartialKeepsDefaultTags(t *testing.T) {
+	tmpl := New(Options{Delimiters: Delimiters{VariableStart: "[[", VariableEnd: "]]"}})
+	result, err := tmpl.Render("[%- if title -%] [[- title|upper -]] [% endif %]", map[string]any{"title": "Intro"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "[%- if title -%]INTRO[% endif %]" {
+		t.Errorf("Expected '[%%- if title -%%]INTRO[%% endif %%]', got '%s'", result)
+	}
+}
+
+func TestCustomDelimitersPartialWhitespaceControl(t *testing.T) {
+	tmpl := New(Options{Delimiters: Delimiters{VariableStart: "[[", VariableEnd: "]]"}})
+	result, err := tmpl.Render("{% if title -%} [[- title|upper -]] {%- endif %}", map[string]any{"title": "Intro"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "INTRO" {
+		t.Errorf("Expected 'INTRO', got '%s'", result)
+	}
+}
+
+func TestCustomDelimitersPartialRaw(t *testing.T) {
+	tmpl := New(Options{Delimiters: Delimiters{VariableStart: "[[", VariableEnd: "]]"}})
+	result, err := tmpl.Render("{% raw %}[[ title ]]{% endraw %}", map[string]any{"title": "Intro"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "[[ title ]]" {
+		t.Errorf("Expected '[[ title ]]', got '%s'", result)
+	}
+}
+
+func TestCustomDelimitersPartialError(t *testing.T) {
+	tmpl := New(Options{Delimiters: Delimiters{VariableStart: "[[", VariableEnd: "]]"}})
+	result, _ := tmpl.Render("[[ missing ]]", map[string]any{})
+	if result != "[[missing!!path `missing` not found]]" {
+		t.Errorf("Expected '[[missing!!path `missing` not found]]', got '%s'", result)
+	}
+}
+
+func TestCustomDelimitersPartialUnterminated(t *testing.T) {
+	tmpl := New(Options{Delimiters: Delimiters{VariableStart: "[[", VariableEnd: "]]"}})
+	_, err := tmpl.Render("a [[ title", map[string]any{})
+	if err == nil || err.Error() != "template:1:3: unterminated variable, expected `]]`" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestZeroValueTemplate(t *testing.T) {
+	var tmpl Template
+	result, err := tmpl.Render("{{ 1 + 1 }}{% if x %}x{% endif %}", map[string]any{"x": true})
+	if err != nil || result != "2x" {
+		t.Errorf("Expected '2x', got '%s' (%v)", result, err)
+	}
+}
+
+func TestZeroValueTemplateInclude(t *testing.T) {
+	tmpl := Template{loader: func(name string) (string, error) { return "{{ name }}", nil }}
+	tmpl.AddGlobal("name", "inc")
+	result, err := tmpl.Render("{% include 'a.html' %}", map[string]any{})
+	if err != nil || result != "inc" {
+		t.Errorf("Expected 'inc', got '%s' (%v)", result, err)
+	}
+}
+
+func TestSetAssignment(t *testing.T) {
+	tmpl := "{% set total = price * count %}{% set label = name|upper %}{{ label }}: {{ total }}"
+	result, err := template.Render(tmpl, map[string]any{"price": 3, "count": 4, "name": "apples"})
+	if err != nil || result != "APPLES: 12" {
+		t.Errorf("Expected 'APPLES: 12', got '%s' (%v)", result, err)
+	}
+}
+
+func TestSetCapture(t *testing.T) {
+	tmpl := "{% set greeting %}Hello <b>{{ name }}</b>{% endset %}{% set shout|upper %}<i>{{ first }}</i>!{% endset %}[{{ greeting }}] [{{ shout }}]"
+	expected := "[Hello <b>&lt;Tom&gt;</b>] [<I>TOM</I>!]"
+	result, err := template.Render(tmpl, map[string]any{"name": "<Tom>", "first": "Tom"})
+	if err != nil || result != expected {
+		t.Errorf("Expected '%s', got '%s' (%v)", expected, result, err)
+	}
+}
+
+func TestSetScopingLoop(t *testing.T) {
+	data := map[string]any{"items": []any{1, 2}, "x": "outer"}
+	result, err := template.Render("{% for i in items %}{% set x = i %}{{ x }}{% endfor %}{{ x }}", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "12outer" {
+		t.Errorf("Expected '12outer', got '%s'", result)
+	}
+	if data["x"] != "outer" {
+		t.Errorf("Expected data not to be modified, got %v", data["x"])
+	}
+}
+
+func TestSetScopingIf(t *testing.T) {
+	data := map[string]any{"items": []any{1, 2}, "x": "outer"}
+	result, err := template.Render(`{% if items %}{% set x = "inner" %}{% endif %}{{ x }}`, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "inner" {
+		t.Errorf("Expected 'inner', got '%s'", result)
+	}
+}
+
+func TestSetScopingBlock(t *testing.T) {
+	data := map[string]any{"items": []any{1, 2}, "x": "outer"}
+	result, err := template.Render(`{% block a %}{% set x = "inner" %}{{ x }}{% endblock %}{{ x }}`, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "innerouter" {
+		t.Errorf("Expected 'innerouter', got '%s'", result)
+	}
+}
+
+func TestSetWithIncludeAndExtends(t *testing.T) {
+	templates := map[string]string{
+		"base.html":    "<title>{% block title %}{% endblock %}</title>{% include 'partial.html' %}{{ title }}",
+		"partial.html": "{% set title = \"partial\" %}[{{ title }}]",
+		"page.html":    "{% extends 'base.html' %}{% set title = \"Page\" %}{% block title %}{{ title }}{% endblock %}",
+	}
+	tmpl := NewTemplateWithLoader(func(name string) (string, error) {
+		return templates[name], nil
+	})
+	result, err := tmpl.RenderFile("page.html", map[string]any{})
+	if err != nil || result != "<title>Page</title>[partial]Page" {
+		t.Errorf("Expected '<title>Page</title>[partial]Page', got '%s' (%v)", result, err)
+	}
+}
+
+func TestSetUndefined(t *testing.T) {
+	tmpl := New(Options{Undefined: UndefinedLenient})
+	result, _ := tmpl.Render("{% set x = missing %}{{ x is defined }}", map[string]any{})
+	if result != "" {
+		t.Errorf("Expected '', got '%s'", result)
+	}
+	result, _ = template.Render("{% set x = missing %}", map[string]any{})
+	if result != "{% set x = missing!!path `missing` not found %}" {
+		t.Errorf("Unexpected result '%s'", result)
+	}
+}
+
+func TestWithBlock(t *testing.T) {
+	data := map[string]any{"order": map[string]any{"total": 42}, "session": map[string]any{"user": "Ann"}, "total": "outer"}
+	result, err := template.Render("{% with total = order.total, user = session.user|upper %}{{ user }}: {{ total }}{% endwith %} {{ total }}", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "ANN: 42 outer" {
+		t.Errorf("Expected 'ANN: 42 outer', got '%s'", result)
+	}
+}
+
+func TestWithBlockFilterArguments(t *testing.T) {
+	data := map[string]any{"order": map[string]any{"total": 42, "items": []any{"a", "b"}}}
+	result, err := template.Render(`{% with list = order.items|join(", "), n = order.total %}{{ list }} {{ n }}{% endwith %}`, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "a, b 42" {
+		t.Errorf("Expected 'a, b 42', got '%s'", result)
+	}
+}
+
+func TestWithBlockAssignsFromOuterScope(t *testing.T) {
+	data := map[string]any{"total": "outer"}
+	result, err := template.Render("{% with total = 1, next = total %}{{ next }}{% endwith %}", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "outer" {
+		t.Errorf("Expected 'outer', got '%s'", result)
+	}
+}
+
+func TestWithBlockScopesSet(t *testing.T) {
+	data := map[string]any{"total": "outer"}
+	result, err := template.Render("{% with %}{% set total = 2 %}{{ total }}{% endwith %}{{ total }}", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "2outer" {
+		t.Errorf("Expected '2outer', got '%s'", result)
+	}
+}
+
+func TestWithInclude(t *testing.T) {
+	templates := map[string]string{
+		"page.html": "{% for p in products %}{% with product = p, currency = \"EUR\" %}{% include 'card.html' %}{% endwith %}{% endfor %}",
+		"card.html": "[{{ product.name }} {{ product.price }} {{ currency }}]",
+	}
+	tmpl := NewTemplateWithLoader(func(name string) (string, error) {
+		return templates[name], nil
+	})
+	data := map[string]any{"products": []any{
+		map[string]any{"name": "Pen", "price": 2},
+		map[string]any{"name": "Ink", "price": 5},
+	}}
+	result, err := tmpl.RenderFile("page.html", data)
+	if err != nil || result != "[Pen 2 EUR][Ink 5 EUR]" {
+		t.Errorf("Expected '[Pen 2 EUR][Ink 5 EUR]', got '%s' (%v)", result, err)
+	}
+}
+
+func TestLoopVariable(t *testing.T) {
+	tmpl := "{% for i in items %}{{ loop.index }}/{{ loop.index0 }}/{{ loop.revindex }}/{{ loop.revindex0 }}/{{ loop.length }}" +
+		"{% if loop.first %} first{% endif %}{% if loop.last %} last{% endif %};{% endfor %}"
+	expected := "1/0/3/2/3 first;2/1/2/1/3;3/2/1/0/3 last;"
+	result, err := template.Render(tmpl, map[string]any{"items": []any{"a", "b", "c"}})
+	if err != nil || result != expected {
+		t.Errorf("Expected '%s', got '%s' (%v)", expected, result, err)
+	}
+}
+
+func TestLoopVariableCommaSeparation(t *testing.T) {
+	tmpl := "{% for i in items %}{{ i }}{% if not loop.last %}, {% endif %}{% endfor %}"
+	result, _ := template.Render(tmpl, map[string]any{"items": []any{"a", "b", "c"}})
+	if result != "a, b, c" {
+		t.Errorf("Expected 'a, b, c', got '%s'", result)
+	}
+}
+
+func TestLoopVariablePrevAndNextItem(t *testing.T) {
+	tmpl := "{% for i in items %}[{% if loop.previtem is defined %}{{ loop.previtem }}{% endif %}<{{ i }}>" +
+		"{% if loop.nextitem is defined %}{{ loop.nextitem }}{% endif %}]{% endfor %}"
+	expected := "[<1>2][1<2>3][2<3>]"
+	result, err := template.Render(tmpl, map[string]any{"items": []any{1, 2, 3}})
+	if err != nil || result != expected {
+		t.Errorf("Expected '%s', got '%s' (%v)", expected, result, err)
+	}
+}
+
+func TestLoopVariableNested(t *testing.T) {
+	tmpl := "{% for row in rows %}{% for cell in row %}{{ loop.parent.index }}.{{ loop.index }}@{{ loop.depth }} {% endfor %}" +
+		"@{{ loop.depth }}{% if loop.parent is undefined %}!{% endif %} {% endfor %}{{ loop is defined }}"
+	expected := "1.1@2 1.2@2 @1! 2.1@2 @1! "
+	result, err := template.Render(tmpl, map[string]any{"rows": []any{[]any{"a", "b"}, []any{"c"}}})
+	if err != nil || result != expected {
+		t.Errorf("Expected '%s', got '%s' (%v)", expected, result, err)
+	}
+}
+
+func TestForElse(t *testing.T) {
+	tmpl := "<ul>\n{% for i in items %}\n  <li>{{ i }}</li>\n{% else %}\n  <li>No items</li>\n{% endfor %}\n</ul>"
+	result, err := template.Render(tmpl, map[string]any{"items": []any{1, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "<ul>\n  <li>1</li>\n  <li>2</li>\n</ul>" {
+		t.Errorf("Expected %q, got %q", "<ul>\n  <li>1</li>\n  <li>2</li>\n</ul>", result)
+	}
+}
+
+func TestForElseEmptySlice(t *testing.T) {
+	tmpl := "<ul>\n{% for i in items %}\n  <li>{{ i }}</li>\n{% else %}\n  <li>No items</li>\n{% endfor %}\n</ul>"
+	result, err := template.Render(tmpl, map[string]any{"items": []any{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "<ul>\n  <li>No items</li>\n</ul>" {
+		t.Errorf("Expected %q, got %q", "<ul>\n  <li>No items</li>\n</ul>", result)
+	}
+}
+
+func TestForElseEmptyMap(t *testing.T) {
+	tmpl := "<ul>\n{% for i in items %}\n  <li>{{ i }}</li>\n{% else %}\n  <li>No items</li>\n{% endfor %}\n</ul>"
+	result, err := template.Render(tmpl, map[string]any{"items": map[string]any{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "<ul>\n  <li>No items</li>\n</ul>" {
+		t.Errorf("Expected %q, got %q", "<ul>\n  <li>No items</li>\n</ul>", result)
+	}
+}
+
+func TestForElseWithIfInside(t *testing.T) {
+	tmpl := "{% for i in items %}{% if i > 1 %}big{% else %}small{% endif %};{% else %}empty{% endfor %}"
+	result, _ := template.Render(tmpl, map[string]any{"items": []any{1, 2}})
+	if result != "small;big;" {
+		t.Errorf("Expected 'small;big;', got '%s'", result)
+	}
+	result, _ = template.Render(tmpl, map[string]any{"items": []any{}})
+	if result != "empty" {
+		t.Errorf("Expected 'empty', got '%s'", result)
+	}
+}
+
+func TestForElseUndefined(t *testing.T) {
+	tmpl := New(Options{Undefined: UndefinedLenient})
+	result, _ := tmpl.Render("{% for i in missing %}{{ i }}{% else %}none{% endfor %}", map[string]any{})
+	if result != "none" {
+		t.Errorf("Expected 'none', got '%s'", result)
+	}
+}
+
+func TestBreak(t *testing.T) {
+	data := map[string]any{"items": []any{1, 2, 3, 4, 5}}
+	result, err := template.Render("{% for i in items %}{% if i == 3 %}{% break %}{% endif %}{{ i }}{% endfor %}", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "12" {
+		t.Errorf("Expected '12', got '%s'", result)
+	}
+}
+
+func TestContinue(t *testing.T) {
+	data := map[string]any{"items": []any{1, 2, 3, 4, 5}}
+	result, err := template.Render("{% for i in items %}{% if i % 2 == 0 %}{% continue %}{% endif %}{{ i }}{% endfor %}", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "135" {
+		t.Errorf("Expected '135', got '%s'", result)
+	}
+}
+
+func TestBreakWithCondition(t *testing.T) {
+	data := map[string]any{"items": []any{1, 2, 3, 4, 5}}
+	result, err := template.Render("{% for i in items %}{% break if i > 2 %}{{ i }}{% endfor %}", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "12" {
+		t.Errorf("Expected '12', got '%s'", result)
+	}
+}
+
+func TestContinueWithCondition(t *testing.T) {
+	data := map[string]any{"items": []any{1, 2, 3, 4, 5}}
+	result, err := template.Render("{% for i in items %}{% continue if i < 4 %}{{ i }}{% endfor %}", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "45" {
+		t.Errorf("Expected '45', got '%s'", result)
+	}
+}
+
+func TestContinueKeepsLoopMetadata(t *testing.T) {
+	data := map[string]any{"items": []any{1, 2, 3, 4, 5}}
+	result, err := template.Render("{% for i in items %}{% continue if i == 2 %}{{ loop.index }}{% if loop.last %}.{% endif %}{% endfor %}", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "1345." {
+		t.Errorf("Expected '1345.', got '%s'", result)
+	}
+}
+
+func TestBreakDoesNotRenderElse(t *testing.T) {
+	data := map[string]any{"items": []any{1, 2, 3, 4, 5}}
+	result, err := template.Render("{% for i in items %}{% break %}{% else %}empty{% endfor %}done", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "done" {
+		t.Errorf("Expected 'done', got '%s'", result)
+	}
+}
+
+func TestBreakInNestedLoop(t *testing.T) {
+	tmpl := "{% for row in rows %}{% for cell in row %}{% break if cell == \"x\" %}{{ cell }}{% endfor %};{% endfor %}"
+	data := map[string]any{"rows": []any{[]any{"a", "x", "b"}, []any{"c", "d"}}}
+	result, err := template.Render(tmpl, data)
+	if err != nil || result != "a;cd;" {
+		t.Errorf("Expected 'a;cd;', got '%s' (%v)", result, err)
+	}
+}
+
+func TestForWithCondition(t *testing.T) {
+	data := map[string]any{"users": []any{
+		map[string]any{"name": "Ann", "active": true},
+		map[string]any{"name": "Bob", "active": false},
+		map[string]any{"name": "Cid", "active": true},
+	}}
+	result, err := template.Render("{% for u in users if u.active %}{{ loop.index }}/{{ loop.length }} {{ u.name }}{% if not loop.last %}, {% endif %}{% endfor %}", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "1/2 Ann, 2/2 Cid" {
+		t.Errorf("Expected '1/2 Ann, 2/2 Cid', got '%s'", result)
+	}
+}
+
+func TestForWithConditionComparingString(t *testing.T) {
+	data := map[string]any{"users": []any{map[string]any{"name": "Ann"}, map[string]any{"name": "Bob"}}}
+	result, err := template.Render(`{% for u in users if u.name == "Bob" %}{{ u.name }}{% endfor %}`, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "Bob" {
+		t.Errorf("Expected 'Bob', got '%s'", result)
+	}
+}
+
+func TestForWithConditionIfInString(t *testing.T) {
+	data := map[string]any{"users": []any{map[string]any{"name": "Ann"}, map[string]any{"name": "Bob"}}}
+	result, err := template.Render(`{% for u in users if u.name == " if " %}{{ u.name }}{% else %}none{% endfor %}`, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "none" {
+		t.Errorf("Expected 'none', got '%s'", result)
+	}
+}
+
+func TestForWithConditionOnKey(t *testing.T) {
+	data := map[string]any{"users": []any{"Ann", "Bob", "Cid"}}
+	result, err := template.Render("{% for i, u in users if i > 0 %}{{ i }}{% endfor %}", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "12" {
+		t.Errorf("Expected '12', got '%s'", result)
+	}
+}
+
+func TestForRecursive(t *testing.T) {
+	tmpl := "<ul>{% for item in menu recursive %}<li>{{ item.title }}@{{ loop.depth }}" +
+		"{% if item.children|length %}<ul>{{ loop(item.children) }}</ul>{% endif %}</li>{% endfor %}</ul>"
+	data := map[string]any{"menu": []any{
+		map[string]any{"title": "A", "children": []any{
+			map[string]any{"title": "A1", "children": []any{}},
+			map[string]any{"title": "A2", "children": []any{
+				map[string]any{"title": "A2a", "children": []any{}},
+			}},
+		}},
+		map[string]any{"title": "<B>", "children": []any{}},
+	}}
+	expected := "<ul><li>A@1<ul><li>A1@2</li><li>A2@2<ul><li>A2a@3</li></ul></li></ul></li><li>&lt;B&gt;@1</li></ul>"
+	result, err := template.Render(tmpl, data)
+	if err != nil || result != expected {
+		t.Errorf("Expected '%s', got '%s' (%v)", expected, result, err)
+	}
+}
+
+func TestForRecursiveWithCondition(t *testing.T) {
+	tmpl := "{% for n in tree if n.visible recursive %}{{ n.name }}({{ loop(n.children) }}){% endfor %}"
+	data := map[string]any{"tree": []any{
+		map[string]any{"name": "a", "visible": true, "children": []any{
+			map[string]any{"name": "b", "visible": false, "children": []any{}},
+			map[string]any{"name": "c", "visible": true, "children": []any{}},
+		}},
+	}}
+	result, err := template.Render(tmpl, data)
+	if err != nil || result != "a(c())" {
+		t.Errorf("Expected 'a(c())', got '%s' (%v)", result, err)
+	}
+}
+
+func TestLoopCallOutsideRecursiveLoop(t *testing.T) {
+	result, _ := template.Render("{% for i in items %}{{ loop(i) }}{% endfor %}", map[string]any{"items": []any{1}})
+	if result != "{{loop(i)!!`loop()` can only be used in a recursive loop}}" {
+		t.Errorf("Unexpected result '%s'", result)
+	}
+
+	tmpl := New(Options{MaxIncludeDepth: 5})
+	tree := map[string]any{}
+	tree["children"] = []any{tree}
+	result, _ = tmpl.Render("{% for n in tree.children recursive %}x{{ loop(n.children) }}{% endfor %}", map[string]any{"tree": tree})
+	if result != "xxxxx{{loop(n.children)!!maximum loop depth of 5 exceeded}}" {
+		t.Errorf("Unexpected result '%s'", result)
+	}
+}
+
+func TestForMapSortedByKey(t *testing.T) {
+	data := map[string]any{"words": map[string]any{"banana": 2, "apple": 1, "cherry": 3, "Date": 4}}
+	for range 10 {
+		result, err := template.Render("{% for k, v in words %}{{ k }}={{ v }} {% endfor %}", data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != "Date=4 apple=1 banana=2 cherry=3 " {
+			t.Fatalf("Expected 'Date=4 apple=1 banana=2 cherry=3 ', got '%s'", result)
+		}
+	}
+}
+
+func TestForMapNumericKeysSortedByValue(t *testing.T) {
+	data := map[string]any{"numbers": map[string]any{"10": "ten", "2": "two", "1": "one", "x": "ex"}}
+	for range 10 {
+		result, err := template.Render("{% for k, v in numbers %}{{ k }} {% endfor %}", data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != "1 2 10 x " {
+			t.Fatalf("Expected '1 2 10 x ', got '%s'", result)
+		}
+	}
+}
+
+func TestForMapValuesSortedByKey(t *testing.T) {
+	data := map[string]any{"numbers": map[string]any{"10": "ten", "2": "two", "1": "one", "x": "ex"}}
+	for range 10 {
+		result, err := template.Render("{% for v in numbers %}{{ v }} {% endfor %}", data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != "one two ten ex " {
+			t.Fatalf("Expected 'one two ten ex ', got '%s'", result)
+		}
+	}
+}
+
+func TestForMapMixedKeysTotalOrder(t *testing.T) {
+	data := map[string]any{
+		"m": map[string]any{"10": 1, "9": 2, "1a": 3, "b": 4, "100": 5, "2x": 6, "NaN": 7, "inf": 8, "1e3": 9, "-1": 10, "2.5": 11},
+	}
+	for range 100 {
+		result, err := template.Render("{% for k, v in m %}{{ k }} {% endfor %}", data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != "-1 2.5 9 10 100 1a 1e3 2x NaN b inf " {
+			t.Fatalf("Expected '-1 2.5 9 10 100 1a 1e3 2x NaN b inf ', got '%s'", result)
+		}
+	}
+}
+
+func TestOrderedMap(t *testing.T) {
+	m := NewOrderedMap()
+	m.Set("z", 1)
+	m.Set("a", 2)
+	m.Set("m", 3)
+	m.Set("z", 4)
+	m.Delete("m")
+	m.Delete("missing")
+	if keys := m.Keys(); len(keys) != 2 || keys[0] != "z" || keys[1] != "a" || m.Len() != 2 {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+	if value, _ := m.Get("z"); value != 4 {
+		t.Errorf("Expected 4, got %v", value)
+	}
+}
+
+func TestForOrderedMapInsertionOrder(t *testing.T) {
+	m := NewOrderedMap()
+	m.Set("z", 1)
+	m.Set("a", 2)
+	result, _ := template.Render("{% for k, v in m %}{{ k }}={{ v }} {% endfor %}", map[string]any{"m": m})
+	if result != "z=1 a=2 " {
+		t.Errorf("Expected 'z=1 a=2 ', got '%s'", result)
+	}
+}
+
+func TestOrderedMapPaths(t *testing.T) {
+	m := NewOrderedMap()
+	m.Set("z", 4)
+	m.Set("a", map[string]any{"b": "nested"})
+	result, _ := template.Render(`{{ m.z }} {{ m.a.b }} {{ m|attr("z") }} {{ m|length }}`, map[string]any{"m": m})
+	if result != "4 nested 4 2" {
+		t.Errorf("Expected '4 nested 4 2', got '%s'", result)
+	}
+}
+
+func TestOrderedMapDebug(t *testing.T) {
+	m := NewOrderedMap()
+	m.Set("z", 4)
+	m.Set("a", map[string]any{"b": "nested"})
+	result, _ := template.Render("{{ m|debug }}", map[string]any{"m": m})
+	expected := "{\n  &#34;z&#34;: 4,\n  &#34;a&#34;: {\n    &#34;b&#34;: &#34;nested&#34;\n  }\n}"
+	if result != expected {
+		t.Errorf("Expected %q, got %q", expected, result)
+	}
+}
+
+func TestOrderedMapIsIterable(t *testing.T) {
+	result, _ := template.Render("{% if m is iterable %}yes{% endif %}", map[string]any{"m": NewOrderedMap()})
+	if result != "yes" {
+		t.Errorf("Expected 'yes', got '%s'", result)
+	}
+}
+
+func TestOrderedMapZeroValue(t *testing.T) {
+	var zero OrderedMap
+	zero.Set("b", "2")
+	zero.Set("a", "1 2")
+	result, err := template.Render("{{ q|urlencode }}", map[string]any{"q": &zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "b=2&amp;a=1+2" {
+		t.Errorf("Expected 'b=2&amp;a=1+2', got '%s'", result)
+	}
+}
+
+func TestForStringSlice(t *testing.T) {
+	result, _ := template.Render("{% for s in strings %}{{ s }}{% endfor %}", map[string]any{"strings": []string{"a", "b"}})
+	if result != "ab" {
+		t.Errorf("Expected 'ab', got '%s'", result)
+	}
+}
+
+func TestForInt64Slice(t *testing.T) {
+	result, _ := template.Render("{% for i in ints %}{{ i * 2 }}{% endfor %}", map[string]any{"ints": []int64{1, 2, 3}})
+	if result != "246" {
+		t.Errorf("Expected '246', got '%s'", result)
+	}
+}
+
+func TestForArray(t *testing.T) {
+	result, _ := template.Render("{% for b in array %}{% if b %}T{% else %}F{% endif %}{% endfor %}", map[string]any{"array": [2]bool{true, false}})
+	if result != "TF" {
+		t.Errorf("Expected 'TF', got '%s'", result)
+	}
+}
+
+func TestForStructSlice(t *testing.T) {
+	type item struct{ Name string }
+	result, _ := template.Render("{% for s in structs %}{{ loop.index }}{{ s.Name }}{% endfor %}", map[string]any{"structs": []item{{"A"}, {"B"}}})
+	if result != "1A2B" {
+		t.Errorf("Expected '1A2B', got '%s'", result)
+	}
+}
+
+func TestForSliceOfTypedMaps(t *testing.T) {
+	data := map[string]any{"headers": []map[string]string{{"name": "Accept"}, {"name": "Host"}}}
+	result, _ := template.Render(`{% for h in headers %}{{ h.name }}{{ h|attr("name") }} {% endfor %}`, data)
+	if result != "AcceptAccept HostHost " {
+		t.Errorf("Expected 'AcceptAccept HostHost ', got '%s'", result)
+	}
+}
+
+func TestForTypedMapSortedByKey(t *testing.T) {
+	data := map[string]any{"counts": map[string]int{"b": 2, "a": 1, "10": 10}}
+	result, _ := template.Render("{% for k, v in counts %}{{ k }}={{ v + 1 }} {% endfor %}", data)
+	if result != "10=11 a=2 b=3 " {
+		t.Errorf("Expected '10=11 a=2 b=3 ', got '%s'", result)
+	}
+}
+
+func TestForIntKeyedMapSortedByKey(t *testing.T) {
+	data := map[string]any{"numbers": map[int]string{10: "ten", 2: "two", 1: "one"}}
+	result, _ := template.Render("{% for k, v in numbers %}{{ k + 1 }}={{ v }} {% endfor %}", data)
+	if result != "2=one 3=two 11=ten " {
+		t.Errorf("Expected '2=one 3=two 11=ten ', got '%s'", result)
+	}
+}
+
+func TestForStringRunes(t *testing.T) {
+	result, _ := template.Render("{% for i, c in word %}{{ i }}{{ c }}{% endfor %}", map[string]any{"word": "héllo"})
+	if result != "0h1é2l3l4o" {
+		t.Errorf("Expected '0h1é2l3l4o', got '%s'", result)
+	}
+}
+
+func TestForInteger(t *testing.T) {
+	result, _ := template.Render("{% for i in n %}{{ i }}{% endfor %}", map[string]any{"n": 3})
+	if result != "012" {
+		t.Errorf("Expected '012', got '%s'", result)
+	}
+}
+
+func TestForZeroUnsignedInteger(t *testing.T) {
+	result, _ := template.Render("{% for i in zero %}{{ i }}{% else %}none{% endfor %}", map[string]any{"zero": uint8(0)})
+	if result != "none" {
+		t.Errorf("Expected 'none', got '%s'", result)
+	}
+}
+
+func TestForChannel(t *testing.T) {
+	ch := make(chan string, 2)
+	ch <- "x"
+	ch <- "y"
+	close(ch)
+	result, _ := template.Render("{% for c in channel %}{{ c }}{% endfor %}", map[string]any{"channel": ch})
+	if result != "xy" {
+		t.Errorf("Expected 'xy', got '%s'", result)
+	}
+}
+
+func TestForSeq(t *testing.T) {
+	data := map[string]any{"seq": slices.Values([]string{"p", "q"})}
+	result, _ := template.Render("{% for s in seq %}{{ loop.index }}{{ s }}{% endfor %}", data)
+	if result != "1p2q" {
+		t.Errorf("Expected '1p2q', got '%s'", result)
+	}
+}
+
+func TestForSeq2(t *testing.T) {
+	data := map[string]any{"seq2": slices.All([]string{"r", "s"})}
+	result, _ := template.Render("{% for i, s in seq2 %}{{ i }}{{ s }}{% if not loop.first %}{{ loop.previtem }}{% endif %}{% endfor %}", data)
+	if result != "0r1sr" {
+		t.Errorf("Expected '0r1sr', got '%s'", result)
+	}
+}
+
+func TestForSeqWithoutLookahead(t *testing.T) {
+	data := map[string]any{"seq": slices.Values([]string{"p", "q"})}
+	result, _ := template.Render("{% for s in seq %}{{ loop.length }}{% endfor %}", data)
+	if result != "{{loop.length!!path `loop.length` not found}}{{loop.length!!path `loop.length` not found}}" {
+		t.Errorf("Expected '{{loop.length!!path `loop.length` not found}}' twice, got '%s'", result)
+	}
+}
+
+func TestForSeqElse(t *testing.T) {
+	data := map[string]any{"seq": slices.Values([]string{})}
+	result, _ := template.Render("{% for s in seq %}{{ s }}{% else %}none{% endfor %}", data)
+	if result != "none" {
+		t.Errorf("Expected 'none', got '%s'", result)
+	}
+}
+
+func TestForSeqInlineCondition(t *testing.T) {
+	data := map[string]any{"seq": slices.Values([]int{1, 2, 3, 4})}
+	result, _ := template.Render("{% for n in seq if n is even %}{{ loop.index }}:{{ n }} {% endfor %}", data)
+	if result != "1:2 2:4 " {
+		t.Errorf("Expected '1:2 2:4 ', got '%s'", result)
+	}
+}
+
+func TestForBreakStopsInfiniteSeq(t *testing.T) {
+	produced := 0
+	naturals := func(yield func(int) bool) {
+		for i := 0; ; i++ {
+			produced++
+			if !yield(i) {
+				return
+			}
+		}
+	}
+	result, err := template.Render("{% for n in naturals %}{% break if n == 3 %}{{ n }}{% endfor %}", map[string]any{"naturals": naturals})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "012" {
+		t.Errorf("Expected '012', got '%s'", result)
+	}
+	if produced != 4 {
+		t.Errorf("Expected the iterator to produce 4 values, got %d", produced)
+	}
+}
+
+func TestForBreakStopsOpenChannel(t *testing.T) {
+	ch := make(chan int)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case ch <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+	result, err := template.Render("{% for n in channel %}{{ n }}{% break if loop.index == 2 %}{% endfor %}", map[string]any{"channel": ch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "01" {
+		t.Errorf("Expected '01', got '%s'", result)
+	}
+}
+
+func TestForMapLength(t *testing.T) {
+	result, _ := template.Render("{{ counts|length }}", map[string]any{"counts": map[string]int{"b": 2, "a": 1, "10": 10}})
+	if result != "3" {
+		t.Errorf("Expected '3', got '%s'", result)
+	}
+}
+
+func TestSeqIsIterable(t *testing.T) {
+	result, _ := template.Render("{% if seq is iterable %}yes{% endif %}", map[string]any{"seq": slices.Values([]string{"p"})})
+	if result != "yes" {
+		t.Errorf("Expected 'yes', got '%s'", result)
+	}
+}
+
+type testStatus int
+
+func (s testStatus) String() string {
+	return [...]string{"draft", "published"}[s]
+}
+
+type testLevel int
+
+func (l testLevel) String() string {
+	return [...]string{"low", "medium", "high"}[l]
+}
+
+func TestStringerEnumRendersString(t *testing.T) {
+	result, _ := template.Render("{{ level }}", map[string]any{"level": testLevel(2)})
+	if result != "high" {
+		t.Errorf("Expected 'high', got '%s'", result)
+	}
+}
+
+func TestStringerEnumComparesAsNumber(t *testing.T) {
+	result, _ := template.Render("{% if level == 1 %}yes{% else %}no{% endif %}", map[string]any{"level": testLevel(1)})
+	if result != "yes" {
+		t.Errorf("Expected 'yes', got '%s'", result)
+	}
+}
+
+func TestStringerEnumComparesAsString(t *testing.T) {
+	result, _ := template.Render(`{% if level == "medium" %}yes{% else %}no{% endif %}`, map[string]any{"level": testLevel(1)})
+	if result != "yes" {
+		t.Errorf("Expected 'yes', got '%s'", result)
+	}
+}
+
+func TestStringerEnumArithmetic(t *testing.T) {
+	result, _ := template.Render("{{ level + 1 }}", map[string]any{"level": testLevel(1)})
+	if result != "2" {
+		t.Errorf("Expected '2', got '%s'", result)
+	}
+}
+
+func TestStringerEnumZeroIsFalse(t *testing.T) {
+	result, _ := template.Render("{% if level %}yes{% else %}no{% endif %}", map[string]any{"level": testLevel(0)})
+	if result != "no" {
+		t.Errorf("Expected 'no', got '%s'", result)
+	}
+}
+
+func TestStringerEnumMapKeysSortedByValue(t *testing.T) {
+	data := map[string]any{"counts": map[testLevel]int{2: 30, 0: 10, 1: 20}}
+	result, _ := template.Render("{% for k, v in counts %}{{ k }}={{ v }} {% endfor %}", data)
+	if result != "low=10 medium=20 high=30 " {
+		t.Errorf("Expected 'low=10 medium=20 high=30 ', got '%s'", result)
+	}
+}
+
+func TestDurationComparison(t *testing.T) {
+	result, _ := template.Render("{% if wait > 1000 %}slow{% else %}fast{% endif %}", map[string]any{"wait": 2 * time.Second})
+	if result != "slow" {
+		t.Errorf("Expected 'slow', got '%s'", result)
+	}
+}
+
+func TestDurationRound(t *testing.T) {
+	result, _ := template.Render("{{ wait / 1000000|round }}", map[string]any{"wait": 1500 * time.Microsecond})
+	if result != "2" {
+		t.Errorf("Expected '2', got '%s'", result)
+	}
+}
+
+type testAudit struct {
+	Created string `json:"created_at"`
+	Updated string
+}
+
+type testUser struct {
+	*testAudit
+	Name     string            `json:"name"`
+	Email    string            `tq:"mail" json:"email"`
+	Password string            `json:"-"`
+	Status   testStatus        `json:"status"`
+	Scores   map[string]int    `json:"scores"`
+	Labels   map[string]string `json:"labels"`
+	Friend   *testUser         `json:"friend,omitempty"`
+	age      int
+}
+
+func (u testUser) Initial() string {
+	return u.Name[:1]
+}
+
+func (u *testUser) Greeting() (string, error) {
+	if u.Name == "" {
+		return "", errors.New("no name")
+	}
+	return "Hello " + u.Name, nil
+}
+
+func TestStructPaths(t *testing.T) {
+	user := &testUser{Name: "Ann"}
+	data := map[string]any{"user": user, "value": *user}
+	result, err := template.Render("{{ user.name }} {{ user.Name }} {{ value.name }}", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "Ann Ann Ann" {
+		t.Errorf("Expected 'Ann Ann Ann', got '%s'", result)
+	}
+}
+
+func TestStructPathsTagOverridesJSON(t *testing.T) {
+	result, err := template.Render("{{ user.mail }} {{ user.Email }}", map[string]any{"user": &testUser{Email: "ann@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "ann@example.com ann@example.com" {
+		t.Errorf("Expected 'ann@example.com ann@example.com', got '%s'", result)
+	}
+}
+
+func TestStructPathsEmbeddedPointer(t *testing.T) {
+	data := map[string]any{"user": &testUser{testAudit: &testAudit{Created: "2024-01-01", Updated: "2024-02-01"}}}
+	result, err := template.Render("{{ user.created_at }} {{ user.Updated }}", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "2024-01-01 2024-02-01" {
+		t.Errorf("Expected '2024-01-01 2024-02-01', got '%s'", result)
+	}
+}
+
+func TestStructPathsStringer(t *testing.T) {
+	result, err := template.Render(`{{ user.status }} {% if user.status == "published" %}p{% endif %}`, map[string]any{"user": &testUser{Status: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "published p" {
+		t.Errorf("Expected 'published p', got '%s'", result)
+	}
+}
+
+func TestStructPathsTypedMaps(t *testing.T) {
+	user := &testUser{Scores: map[string]int{"math": 9}, Labels: map[string]string{"role": "<admin>"}}
+	data := map[string]any{"user": user}
+	result, err := template.Render("{{ user.scores.math + 1 }} {{ user.labels.role }}", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "10 &lt;admin&gt;" {
+		t.Errorf("Expected '10 &lt;admin&gt;', got '%s'", result)
+	}
+}
+
+func TestStructPathsNilPointer(t *testing.T) {
+	data := map[string]any{"user": &testUser{Friend: &testUser{Name: "Bob"}}}
+	result, err := template.Render("{{ user.friend.name }}{% if user.friend.friend %}x{% endif %}", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "Bob" {
+		t.Errorf("Expected 'Bob', got '%s'", result)
+	}
+}
+
+func TestStructPathsMethods(t *testing.T) {
+	user := &testUser{Name: "Ann"}
+	data := map[string]any{"user": user, "value": *user}
+	result, err := template.Render("{{ user.Initial }} {{ value.Initial }} {{ user.Greeting }}", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "A A Hello Ann" {
+		t.Errorf("Expected 'A A Hello Ann', got '%s'", result)
+	}
+}
+
+func TestStructPathsFilters(t *testing.T) {
+	user := &testUser{Name: "Ann"}
+	data := map[string]any{"user": user, "users": []*testUser{user, {Name: "Bob"}}}
+	result, err := template.Render(`{{ user|attr("name") }} {{ users|join(",", "name") }}`, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "Ann Ann,Bob" {
+		t.Errorf("Expected 'Ann Ann,Bob', got '%s'", result)
+	}
+}
+
+func TestStructPathsHiddenFields(t *testing.T) {
+	data := map[string]any{"user": &testUser{Email: "ann@example.com", Password: "secret"}}
+	result, err := template.Render("{% if user.email is defined %}x{% endif %}{% if user.Password is defined %}x{% endif %}", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "" {
+		t.Errorf("Expected '', got '%s'", result)
+	}
+}
+
+func TestStructPathsUnexportedAndPointerMethods(t *testing.T) {
+	user := &testUser{Name: "Ann", age: 30}
+	data := map[string]any{"user": user, "value": *user}
+	result, err := template.Render("{% if user.age is defined %}x{% endif %}{% if value.Greeting is defined %}x{% endif %}", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "" {
+		t.Errorf("Expected '', got '%s'", result)
+	}
+}
+
+func TestStructPathsNilEmbeddedPointer(t *testing.T) {
+	result, err := template.Render("{% if nobody.created_at is defined %}x{% endif %}", map[string]any{"nobody": &testUser{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "" {
+		t.Errorf("Expected '', got '%s'", result)
+	}
+}
+
+func TestStructPathsMethodError(t *testing.T) {
+	result, _ := template.Render("{{ nobody.Greeting }}", map[string]any{"nobody": &testUser{}})
+	if result != "{{nobody.Greeting!!no name}}" {
+		t.Errorf("Expected '{{nobody.Greeting!!no name}}', got '%s'", result)
+	}
+}
+
+func TestSubscripts(t *testing.T) {
+	result, err := template.Render("{{ items[0] }}{{ items[i] }}{{ items[i + 1] }}{{ items[-1] }}", map[string]any{"items": []any{"a", "b", "c", "d"}, "i": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "abcd" {
+		t.Errorf("Expected 'abcd', got '%s'", result)
+	}
+}
+
+func TestSubscriptDotIndex(t *testing.T) {
+	result, err := template.Render("{{ items.0 }}{{ numbers.2 }} {{ numbers[1] * 2 }}", map[string]any{"items": []any{"a"}, "numbers": []int{10, 20, 30}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "a30 40" {
+		t.Errorf("Expected 'a30 40', got '%s'", result)
+	}
+}
+
+func TestSubscriptMapKey(t *testing.T) {
+	result, err := template.Render(`{{ prices[currency] }} {{ prices["EUR"] }}`, map[string]any{"prices": map[string]any{"EUR": 9.5, "USD": 10}, "currency": "USD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "10 9.5" {
+		t.Errorf("Expected '10 9.5', got '%s'", result)
+	}
+}
+
+func TestSubscriptTypedMapKey(t *testing.T) {
+	result, err := template.Render(`{{ headers["Content-Type"] }} {{ codes[404] }}`, map[string]any{"headers": map[string]string{"Content-Type": "text/html"}, "codes": map[int]string{200: "OK", 404: "Not Found"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "text/html Not Found" {
+		t.Errorf("Expected 'text/html Not Found', got '%s'", result)
+	}
+}
+
+func TestSubscriptChained(t *testing.T) {
+	result, err := template.Render("{{ users[0].name }} {{ users[0].tags[-1] }} {{ users.0.tags.0 }}", map[string]any{"users": []any{map[string]any{"name": "Ann", "tags": []string{"x", "y"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "Ann y x" {
+		t.Errorf("Expected 'Ann y x', got '%s'", result)
+	}
+}
+
+func TestSlice(t *testing.T) {
+	result, err := template.Render("{{ items[1:3]|join }} {{ items[:2]|join }} {{ items[2:]|join }}", map[string]any{"items": []any{"a", "b", "c", "d"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "bc ab cd" {
+		t.Errorf("Expected 'bc ab cd', got '%s'", result)
+	}
+}
+
+func TestSliceNegativeAndEmpty(t *testing.T) {
+	result, err := template.Render("{{ items[-2:]|join }} {{ items[3:1]|length }} {{ items[:]|join }}", map[string]any{"items": []any{"a", "b", "c", "d"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "cd 0 abcd" {
+		t.Errorf("Expected 'cd 0 abcd', got '%s'", result)
+	}
+}
+
+func TestSliceString(t *testing.T) {
+	result, err := template.Render("{{ name[:5] }}|{{ name[-5:] }}|{{ name[1] }}", map[string]any{"name": "héllo world"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "héllo|world|é" {
+		t.Errorf("Expected 'héllo|world|é', got '%s'", result)
+	}
+}
+
+func TestSubscriptOfParenthesizedSlice(t *testing.T) {
+	result, err := template.Render("{{ (items[1:])[0] }}{{ items[1 - 1] }}", map[string]any{"items": []any{"a", "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "ba" {
+		t.Errorf("Expected 'ba', got '%s'", result)
+	}
+}
+
+func TestForOverSlice(t *testing.T) {
+	result, err := template.Render("{% for n in numbers[1:] %}{{ n }} {% endfor %}", map[string]any{"numbers": []int{10, 20, 30}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "20 30 " {
+		t.Errorf("Expected '20 30 ', got '%s'", result)
+	}
+}
+
+func TestSubscriptIsDefined(t *testing.T) {
+	result, err := template.Render("{% if items[4] is defined %}yes{% else %}no{% endif %}", map[string]any{"items": []any{"a", "b", "c", "d"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "no" {
+		t.Errorf("Expected 'no', got '%s'", result)
+	}
+}
+
+func TestSubscriptInOperators(t *testing.T) {
+	result, err := template.Render("{% if not items[0] %}x{% endif %}{{ items[0] + items[1] }}", map[string]any{"items": []any{"a", "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "ab" {
+		t.Errorf("Expected 'ab', got '%s'", result)
+	}
+}
+
+func TestSubscriptIndexNotFound(t *testing.T) {
+	result, _ := template.Render("{{ items[5] }}", map[string]any{"items": []any{"a"}})
+	if result != "{{items[5]!!path `items[5]` not found}}" {
+		t.Errorf("Expected '{{items[5]!!path `items[5]` not found}}', got '%s'", result)
+	}
+}
+
+func TestSubscriptKeyNotFound(t *testing.T) {
+	result, _ := template.Render("{{ prices[key] }}", map[string]any{"prices": map[string]any{}, "key": "x"})
+	if result != "{{prices[key]!!path `prices[key]` not found}}" {
+		t.Errorf("Expected '{{prices[key]!!path `prices[key]` not found}}', got '%s'", result)
+	}
+}
+
+func TestSubscriptOfMissingPath(t *testing.T) {
+	result, _ := template.Render("{{ missing[0].a }}", map[string]any{})
+	if result != "{{missing[0].a!!path `missing[0].a` not found}}" {
+		t.Errorf("Expected '{{missing[0].a!!path `missing[0].a` not found}}', got '%s'", result)
+	}
+}
+
+func TestSubscriptFloatIndex(t *testing.T) {
+	result, _ := template.Render("{{ items[0.5] }}", map[string]any{"items": []any{"a"}})
+	if result != "{{items[0.5]!!index must be an integer, not 0.5}}" {
+		t.Errorf("Expected '{{items[0.5]!!index must be an integer, not 0.5}}', got '%s'", result)
+	}
+}
+
+func TestSliceOutOfRange(t *testing.T) {
+	result, _ := template.Render("{{ key[1:2] }}", map[string]any{"key": "x"})
+	if result != "" {
+		t.Errorf("Expected '', got '%s'", result)
+	}
+}
+
+func TestSliceMapError(t *testing.T) {
+	result, _ := template.Render("{{ prices[:1] }}", map[string]any{"prices": map[string]any{}})
+	if result != "{{prices[:1]!!cannot slice map[string]interface {}}}" {
+		t.Errorf("Expected '{{prices[:1]!!cannot slice map[string]interface {}}}', got '%s'", result)
+	}
+}
+
+func TestSubscriptUnmatchedBracket(t *testing.T) {
+	result, _ := template.Render("{{ items] }}", map[string]any{"items": []any{"a"}})
+	if result != "{{items]!!malformed expression, unmatched `]`}}" {
+		t.Errorf("Expected '{{items]!!malformed expression, unmatched `]`}}', got '%s'", result)
+	}
+}
+
+func TestSubscriptUnclosedBracket(t *testing.T) {
+	result, _ := template.Render("{{ items[0 }}", map[string]any{"items": []any{"a"}})
+	if result != "{{items[0!!malformed expression, unmatched `[`}}" {
+		t.Errorf("Expected '{{items[0!!malformed expression, unmatched `[`}}', got '%s'", result)
+	}
+}
+
+func TestUnmatchedParenthesis(t *testing.T) {
+	result, _ := template.Render("{{ (a + 1)) }}", map[string]any{"a": 1})
+	if result != "{{(a + 1))!!malformed expression, unmatched `)`}}" {
+		t.Errorf("Expected '{{(a + 1))!!malformed expression, unmatched `)`}}', got '%s'", result)
+	}
+}
+
+func TestFilterArgumentSubscript(t *testing.T) {
+	result, err := template.Render("{{ m|default(items[0]) }}", map[string]any{"items": []any{"first"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "first" {
+		t.Errorf("Expected 'first', got '%s'", result)
+	}
+}
+
+func TestFilterArgumentExpression(t *testing.T) {
+	result, err := template.Render(`{{ words|join(sep + " ") }}`, map[string]any{"words": []any{"a", "b"}, "sep": ","})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "a, b" {
+		t.Errorf("Expected 'a, b', got '%s'", result)
+	}
+}
+
+type testPage struct {
+	Title string     `json:"title"`
+	User  *testUser  `json:"user"`
+	Items []string   `json:"items"`
+	Site  string     `json:"site"`
+	Tags  []testPage `json:"-"`
+}
+
+func (p testPage) Heading() string {
+	return strings.ToUpper(p.Title)
+}
+
+func TestRenderAny(t *testing.T) {
+	tmpl := New(Options{Globals: map[string]any{"site": "global", "year": 2024}})
+	page := testPage{Title: "Home", User: &testUser{Name: "Ann"}, Items: []string{"a", "b"}, Site: "page"}
+	source := "{{ title }}/{{ Heading }}/{{ user.name }}/{% for i in items %}{{ i }}{% endfor %}/{{ site }}/{{ year }}" +
+		"{% set title = \"Set\" %}/{{ title }}{% with %}/{{ items[1] }}{% endwith %}"
+	expected := "Home/HOME/Ann/ab/page/2024/Set/b"
+
+	for _, data := range []any{page, &page} {
+		result, err := tmpl.RenderAny(source, data)
+		if err != nil || result != expected {
+			t.Errorf("Expected '%s', got '%s' (%v)", expected, result, err)
+		}
+	}
+
+	result, err := tmpl.RenderAny("{{ a }}{{ b }} {{ year }}", map[string]int{"a": 1, "b": 2})
+	if err != nil || result != "12 2024" {
+		t.Errorf("Unexpected result '%s' (%v)", result, err)
+	}
+
+	result, err = tmpl.RenderAny("{% if Tags is defined %}x{% endif %}{{ year }}", nil)
+	if err != nil || result != "2024" {
+		t.Errorf("Unexpected result '%s' (%v)", result, err)
+	}
+
+	_, err = tmpl.RenderAny("x", []string{"a"})
+	if err == nil || err.Error() != "data must be a map with string keys or a struct, not []string" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestRenderFileAny(t *testing.T) {
+	tmpl := New(Options{Loader: func(name string) (string, error) {
+		switch name {
+		case "page.html":
+			return "{% extends \"base.html\" %}{% block body %}{{ Heading }}{% endblock %}", nil
+		case "base.html":
+			return "<h1>{% block body %}{% endblock %}</h1>{% include \"footer.html\" %}", nil
+		}
+		return "<p>{{ title }}</p>", nil
+	}})
+	page := &testPage{Title: "About"}
+
+	result, err := tmpl.RenderFileAny("page.html", page)
+	if err != nil || result != "<h1>ABOUT</h1><p>About</p>" {
+		t.Errorf("Unexpected result '%s' (%v)", result, err)
+	}
+}
+
+func TestLoopCycleMethod(t *testing.T) {
+	result, _ := template.Render("{% for i in items %}{{ loop.cycle(\"odd\", \"even\") }} {% endfor %}", map[string]any{"items": []any{1, 2, 3}})
+	if result != "odd even odd " {
+		t.Errorf("Expected 'odd even odd ', got '%s'", result)
+	}
+}
+
+func TestLoopCycleMethodInExpression(t *testing.T) {
+	result, _ := template.Render("{% for i in items %}{% if loop.cycle(1, 0) %}{{ \"row-\" + loop.cycle(a, b) }} {% endif %}{% endfor %}", map[string]any{"items": []any{1, 2, 3}, "a": "x", "b": "y"})
+	if result != "row-x row-x " {
+		t.Errorf("Expected 'row-x row-x ', got '%s'", result)
+	}
+}
+
+func TestCallFunctionValue(t *testing.T) {
+	data := map[string]any{
+		"add":   func(a, b int) int { return a + b },
+		"price": 2,
+	}
+	result, _ := template.Render("{{ add(price, 3) * 2 }}", data)
+	if result != "10" {
+		t.Errorf("Expected '10', got '%s'", result)
+	}
+}
+
+func TestCallNonFunction(t *testing.T) {
+	result, _ := template.Render("{{ name(1) }}", map[string]any{"name": "x"})
+	if result != "{{name(1)!!`name` is not a function}}" {
+		t.Errorf("Expected error message, got '%s'", result)
+	}
+}
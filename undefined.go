@@ -0,0 +1,60 @@
+package tqtemplate
+
+import "fmt"
+
+// UndefinedPolicy determines how variables and paths that do not exist are handled
+type UndefinedPolicy int
+
+const (
+	// UndefinedStrict makes using an undefined value an error (default)
+	UndefinedStrict UndefinedPolicy = iota
+	// UndefinedLenient renders undefined values as empty strings, but accessing
+	// an attribute of an undefined value is an error
+	UndefinedLenient
+	// UndefinedChainable is like UndefinedLenient, but accessing an attribute of
+	// an undefined value results in another undefined value
+	UndefinedChainable
+	// UndefinedDebug is like UndefinedLenient, but renders the missing name as
+	// "{{ name }}" in the output
+	UndefinedDebug
+)
+
+// Undefined is the value of a variable or path that does not exist. It can be
+// checked with the "defined" and "undefined" tests and the "default" filter.
+type Undefined struct {
+	Name   string // the path that was not found
+	policy UndefinedPolicy
+}
+
+// String returns an empty string, so undefined values never leak into output
+func (u Undefined) String() string {
+	return ""
+}
+
+// value returns the value to use in place of the undefined value, or an error
+// when the policy does not allow undefined values to be used
+func (u Undefined) value() (any, error) {
+	if u.policy == UndefinedStrict {
+		return nil, u.err()
+	}
+	return nil, nil
+}
+
+// err returns the error for using or accessing the undefined value
+func (u Undefined) err() error {
+	return fmt.Errorf("path `%s` not found", u.Name)
+}
+
+// acceptsUndefined returns true for filters and tests that handle undefined values
+func (call filterCall) acceptsUndefined() bool {
+	switch call.name {
+	case "default", "defined", "undefined":
+		return true
+	case "__istest__", "__isnot__":
+		if len(call.args) > 0 {
+			name := call.args[0].value
+			return name == "defined" || name == "undefined"
+		}
+	}
+	return false
+}